@@ -2,84 +2,789 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Aof struct {
 	w    *Writer
-	f    *os.File
+	f    *os.File // the incremental file records are appended to
 	conf *Config
+	dir  string // appenddirname, inside the data directory
+
+	// mu serialises records from handlers running on different databases.
+	mu sync.Mutex
+	// db is the database the last record was logged against, -1 when the
+	// next record must be preceded by a SELECT.
+	db int
+	// tx collects the records of the running EXEC, which are written out
+	// together as one MULTI/EXEC block. It is nil outside EXEC.
+	tx []aofRecord
+	// ts is the unix time of the last #TS annotation written to the
+	// current incremental file, 0 when it has none yet.
+	ts int64
+	// manifest lists the files making up the AOF, see manifest.go.
+	manifest *aofManifest
+	// rewriteFrom is the sequence number of the first incremental file
+	// the running rewrite's snapshot does not cover, 0 when none runs.
+	rewriteFrom int
+}
+
+type aofRecord struct {
+	db int
+	r  *Resp
 }
 
+// NewAof opens the AOF described by the manifest in the AOF directory,
+// starting one when there is none, and appends to its last incremental
+// file.
 func NewAof(conf *Config) *Aof {
-	aof := Aof{conf: conf}
+	aof := Aof{conf: conf, db: -1, dir: path.Join(conf.dir, conf.aofDirName)}
+	if err := os.MkdirAll(aof.dir, 0755); err != nil {
+		log.Fatalln("cannot create AOF directory:", err)
+	}
+	// leftovers of a rewrite that never finished
+	tmps, _ := filepath.Glob(path.Join(aof.dir, "temp-*"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
 
-	fp := path.Join(aof.conf.dir, aof.conf.aofFn)
-	f, err := os.OpenFile(fp, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644) // owner (read-write) others (readonly)
+	m, err := loadManifest(aof.dir, conf.aofFn)
 	if err != nil {
-		fmt.Println("cannot open:", fp)
-		return &aof
+		log.Fatalln("cannot load AOF manifest:", err)
 	}
-	aof.w = NewWrite(f)
-	aof.f = f
+	if m == nil {
+		m = aof.adoptLegacy()
+	}
+	aof.manifest = m
 
+	if len(m.incrs) == 0 {
+		if err := aof.openIncr(); err != nil {
+			log.Fatalln("cannot start AOF:", err)
+		}
+		return &aof
+	}
+	last := m.incrs[len(m.incrs)-1]
+	f, err := os.OpenFile(path.Join(aof.dir, last.name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalln("cannot open AOF:", err)
+	}
+	aof.f, aof.w = f, NewWrite(f)
 	return &aof
 }
 
-func (aof *Aof) Sync() {
-	rd := bufio.NewReader(aof.f)
+// adoptLegacy starts the manifest of a new AOF directory. The single AOF
+// file of earlier versions, if there is one, is moved into the directory
+// and becomes its base, under its old name so a crash before the manifest
+// is written still finds it.
+func (aof *Aof) adoptLegacy() *aofManifest {
+	m := &aofManifest{}
+	legacy := path.Join(aof.conf.dir, aof.conf.aofFn)
+	moved := path.Join(aof.dir, aof.conf.aofFn)
+	if _, err := os.Stat(legacy); err == nil {
+		if err := os.Rename(legacy, moved); err != nil {
+			log.Fatalln("cannot move AOF into its directory:", err)
+		}
+		log.Println("moved", legacy, "to", moved)
+	}
+	if _, err := os.Stat(moved); err == nil {
+		m.base = &aofFile{name: aof.conf.aofFn, seq: 1, typ: aofBaseType}
+	}
+	return m
+}
+
+// openIncr starts a new incremental file, adds it to the manifest and
+// switches logging to it. The caller must hold aof.mu.
+func (aof *Aof) openIncr() error {
+	incr := aof.manifest.nextIncr(aof.conf.aofFn)
+	fp := path.Join(aof.dir, incr.name)
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	m := &aofManifest{base: aof.manifest.base, incrs: append(slices.Clone(aof.manifest.incrs), incr)}
+	if err := writeManifest(aof.dir, aof.conf.aofFn, m); err != nil {
+		f.Close()
+		os.Remove(fp)
+		return err
+	}
+
+	if aof.f != nil {
+		aof.w.Flush()
+		aof.f.Close()
+	}
+	aof.f, aof.w, aof.db, aof.ts, aof.manifest = f, NewWrite(f), -1, 0, m
+	return nil
+}
+
+// Sync replays the AOF into the databases, the files in manifest order.
+// Each record is dispatched through Handlers on behalf of a replay client,
+// against the server's configuration with AOF logging and maxmemory
+// switched off, so replayed writes are neither logged again nor evicted.
+// The writes of a MULTI/EXEC block are applied when its EXEC is read.
+//
+// Records that fail are logged with their file and offset and skipped.
+// When the last file is cut short mid-record, as a crash during a write
+// leaves it, it is truncated back to its last complete record, dropping
+// an unfinished transaction along with it. Any other malformed record, or
+// a truncated earlier file, stops the server.
+//
+// A non-zero until restores the databases to that unix time: replay stops
+// at the first #TS annotation past it, and the AOF is cut short there, see
+// truncateHistory.
+func (aof *Aof) Sync(until int64) {
+	conf := *aof.conf
+	conf.aofEnabled = false
+	conf.maxmem = 0
+	state := &AppState{conf: &conf}
+
+	files := aof.manifest.files()
+	var n int
+	for i, file := range files {
+		applied, stop := aof.replayFile(file.name, i == len(files)-1, until, state)
+		n += applied
+		if stop >= 0 {
+			if stop == 0 && i > 0 && files[i-1].typ == aofBaseType {
+				log.Println("AOF replay stopped right after the base file: the state restored is that of the last rewrite, which may be later than the time asked for")
+			}
+			aof.truncateHistory(i, stop)
+			files = files[:i+1]
+			break
+		}
+	}
+	log.Printf("replayed %d AOF records from %d files", n, len(files))
+}
+
+// replayFile replays one file of the AOF and reports how many records it
+// applied. Annotation lines, starting with '#', are skipped. When one is
+// a timestamp past a non-zero until, replay stops there and replayFile
+// also returns its offset; otherwise the offset is -1.
+func (aof *Aof) replayFile(name string, last bool, until int64, state *AppState) (int, int64) {
+	fp := path.Join(aof.dir, name)
+	f, err := os.Open(fp)
+	if err != nil {
+		log.Fatalln("cannot open AOF file:", err)
+	}
+	defer f.Close()
+
+	// a client per file, so SELECT records carry over within it
+	c := NewReplayClient()
+	cr := &countingReader{r: f}
+	rd := bufio.NewReader(cr)
+	loadPreamble(rd, name)
+	var tx []aofReplayRecord
+	var txOffset int64 = -1
+	var n int
 	for {
+		offset := cr.n - int64(rd.Buffered())
 		r := Resp{}
-		err := r.parseRespArr(rd)
-		if err == io.EOF {
+		var annotation string
+		var err error
+		if b, _ := rd.Peek(1); len(b) == 1 && b[0] == '#' {
+			annotation, err = rd.ReadString('\n')
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		} else {
+			err = r.parseRespArr(rd)
+		}
+		if err == io.EOF && cr.n-int64(rd.Buffered()) == offset {
+			if txOffset >= 0 {
+				if !last {
+					log.Fatalf("AOF file %s ends inside a MULTI/EXEC block at offset %d", name, txOffset)
+				}
+				log.Printf("AOF file %s ends inside a MULTI/EXEC block, truncating it at offset %d", name, txOffset)
+				truncateAof(fp, txOffset)
+			}
 			break
 		}
-		if err != nil {
-			log.Println("unexpected err while reading AOF records")
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if txOffset >= 0 {
+				offset = txOffset
+			}
+			if !last {
+				log.Fatalf("AOF file %s is truncated at offset %d", name, offset)
+			}
+			log.Printf("AOF file %s is truncated, dropping its last record at offset %d", name, offset)
+			truncateAof(fp, offset)
 			break
 		}
+		if err != nil {
+			log.Fatalf("bad record in AOF file %s at offset %d: %v", name, offset, err)
+		}
+		if annotation != "" {
+			ts, ok := parseTimestampAnnotation(annotation)
+			if ok && until > 0 && ts > until {
+				if txOffset >= 0 {
+					offset = txOffset
+				}
+				log.Printf("AOF file %s reaches %s at offset %d, stopping replay at %s",
+					name, time.Unix(ts, 0).Format(time.RFC3339), offset, time.Unix(until, 0).Format(time.RFC3339))
+				return n, offset
+			}
+			continue
+		}
+		if len(r.arr) == 0 {
+			continue
+		}
 
-		blankState := NewAppState(&Config{})
-		c := Client{}
-		set(&c, &r, blankState)
+		rec := aofReplayRecord{file: name, offset: offset, r: &r}
+		switch strings.ToUpper(r.arr[0].bulk) {
+		case "MULTI":
+			tx, txOffset = []aofReplayRecord{}, offset
+			continue
+		case "EXEC":
+			for _, rec := range tx {
+				n += replayRecord(c, rec, state)
+			}
+			tx, txOffset = nil, -1
+			continue
+		}
+		if txOffset >= 0 {
+			tx = append(tx, rec)
+			continue
+		}
+		n += replayRecord(c, rec, state)
 	}
+	return n, -1
 }
 
-func (aof *Aof) Rewrite(cp map[string]*Item) {
-	// Re-route future AOF records to buffer
-	var b bytes.Buffer
-	aof.w = NewWrite(&b)
+// parseTimestampAnnotation reads the unix time out of a #TS:<unix>
+// annotation line.
+func parseTimestampAnnotation(line string) (int64, bool) {
+	v, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), "#TS:")
+	if !ok {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(v, 10, 64)
+	return ts, err == nil
+}
 
-	// Clear file contents
-	if err := aof.f.Truncate(0); err != nil {
-		log.Println("aof rewrite - truncate error:", err)
+// truncateHistory makes a point-in-time recovery stick by cutting the AOF
+// short where replay stopped, at offset in its i-th file, so that the
+// writes after it are not replayed again on the next start. Nothing is
+// deleted: the tail cut off that file is kept in a file of its own, see
+// discardTail, and the incremental files after it are dropped from the
+// manifest and kept with a .discarded suffix, out of the way of the names
+// new incremental files take. Logging moves on to a new incremental file.
+func (aof *Aof) truncateHistory(i int, offset int64) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	files := aof.manifest.files()
+	fp := path.Join(aof.dir, files[i].name)
+	discardTail(fp, offset)
+	truncateAof(fp, offset)
+	later := files[i+1:]
+	if len(later) == 0 {
 		return
 	}
 
-	if _, err := aof.f.Seek(0, 0); err != nil {
-		log.Println("aof rewrite - seek error:", err)
+	for _, f := range later {
+		fp := path.Join(aof.dir, f.name)
+		if err := os.Rename(fp, fp+".discarded"); err != nil {
+			log.Fatalln("cannot discard AOF file:", err)
+		}
+		log.Println("discarded AOF file", f.name)
+	}
+	incrs := aof.manifest.incrs
+	aof.manifest = &aofManifest{base: aof.manifest.base, incrs: incrs[:len(incrs)-len(later)]}
+	if err := aof.openIncr(); err != nil {
+		log.Fatalln("cannot start AOF:", err)
+	}
+}
+
+// discardTail copies what the AOF file at fp holds past offset to
+// <file>.<offset>.discarded, synced to disk before the file is truncated.
+// Running it again for the same cut, after a crash before the truncation,
+// copies the same bytes again.
+func discardTail(fp string, offset int64) {
+	src, err := os.Open(fp)
+	if err != nil {
+		log.Fatalln("cannot discard AOF file tail:", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		log.Fatalln("cannot discard AOF file tail:", err)
+	}
+	if info.Size() <= offset {
 		return
 	}
 
-	// Rewrite all SET commands to file
-	fwriter := NewWrite(aof.f)
+	name := fmt.Sprintf("%s.%d.discarded", fp, offset)
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatalln("cannot discard AOF file tail:", err)
+	}
+	_, err = src.Seek(offset, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalln("cannot discard AOF file tail:", err)
+	}
+	log.Printf("discarded %d bytes of AOF file %s into %s", info.Size()-offset, path.Base(fp), path.Base(name))
+}
+
+// loadPreamble loads the RDB encoding a file written with an RDB
+// preamble starts with, leaving rd at the commands that follow it. Files
+// without one are left as they are. Gob reads exactly the encoding from
+// rd, being an io.ByteReader.
+func loadPreamble(rd *bufio.Reader, name string) {
+	magic, _ := rd.Peek(len(rdbPreamble))
+	if string(magic) != rdbPreamble {
+		return
+	}
+	rd.Discard(len(rdbPreamble))
+
+	var stores []map[string]*Item
+	if err := gob.NewDecoder(rd).Decode(&stores); err != nil {
+		log.Fatalf("bad RDB preamble in AOF file %s: %v", name, err)
+	}
+	loadStores(stores)
+	var n int
+	for _, store := range stores {
+		n += len(store)
+	}
+	log.Printf("loaded %d keys from the RDB preamble of %s", n, name)
+}
+
+type aofReplayRecord struct {
+	file   string
+	offset int64
+	r      *Resp
+}
+
+// replayRecord runs one AOF record and reports how many records it applied.
+func replayRecord(c *Client, rec aofReplayRecord, state *AppState) int {
+	cmd := strings.ToUpper(rec.r.arr[0].bulk)
+	handler, ok := Handlers[cmd]
+	if !ok {
+		log.Printf("unknown command %q in AOF file %s at offset %d", rec.r.arr[0].bulk, rec.file, rec.offset)
+		return 0
+	}
+	if !checkArity(cmd, len(rec.r.arr)) {
+		log.Printf("AOF record %s in %s at offset %d: %s", cmd, rec.file, rec.offset, argsErr(cmd).err)
+		return 0
+	}
+	if reply := call(cmd, handler, c, rec.r, state); reply != nil && reply.sign == Error {
+		log.Printf("AOF record %s in %s at offset %d: %s", cmd, rec.file, rec.offset, reply.err)
+		return 0
+	}
+	return 1
+}
+
+// countingReader counts the bytes read through it, from which replayFile
+// works out the file offset of each record.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// truncateAof cuts the AOF file at fp short at offset. Records logged
+// later are appended from there.
+func truncateAof(fp string, offset int64) {
+	if err := os.Truncate(fp, offset); err != nil {
+		log.Println("aof truncate error:", err)
+	}
+}
+
+// logAof appends a write command against db to the AOF, preceded by a
+// SELECT when the previous record was for another database, and flushes it
+// straight away when appendfsync is set to always.
+func logAof(state *AppState, db *Database, r *Resp) {
+	if !state.conf.aofEnabled {
+		return
+	}
+	aof := state.aof
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.tx != nil {
+		aof.tx = append(aof.tx, aofRecord{db: db.id, r: r})
+		return
+	}
+
+	log.Println("saving aof file")
+	aof.timestamp()
+	aof.selectDB(db.id)
+	aof.w.Write(r)
+	if state.conf.aofFSync == Always {
+		aof.w.Flush()
+	}
+}
+
+// Propagation. Handlers do not log write commands themselves: call logs
+// a write command once it returns, and only when it changed the dataset,
+// which its handler reports through IncrRDBTracker. A command whose
+// verbatim replay would not reproduce its effect, such as a relative
+// expiry, a random pick or a blocking pop, is logged as the commands that
+// do instead, and changes made on behalf of others, such as evictions and
+// the blocked clients a write serves, are logged along with it. Write
+// commands hold execMu exclusively, so the records reach the AOF in the
+// order the changes were made.
+
+// propagation is what the running write command logs to the AOF.
+type propagation struct {
+	db int // the database the command runs against
+	// cmd is what the command is logged as, nil when it logs nothing but
+	// its alsoPropagate records.
+	cmd *Resp
+	// recs are the records in the order of the changes. The command's own
+	// is the one without a command, added by its first change.
+	recs  []aofRecord
+	dirty bool
+}
+
+// prop is the propagation of the running write command. Only write
+// commands touch it, under execMu held exclusively.
+var prop propagation
+
+// changed marks the running command as having changed the dataset.
+func (p *propagation) changed() {
+	if !p.dirty {
+		p.dirty = true
+		p.recs = append(p.recs, aofRecord{db: p.db})
+	}
+}
+
+// alsoPropagate logs r against db along with the running command, after
+// the records of the changes made so far.
+func alsoPropagate(db *Database, r *Resp) {
+	prop.recs = append(prop.recs, aofRecord{db: db.id, r: r})
+}
+
+// rewriteCommand logs the running command as r rather than as sent.
+func rewriteCommand(r *Resp) {
+	prop.cmd = r
+}
+
+// preventPropagation keeps the running command itself out of the AOF, for
+// commands logged entirely through alsoPropagate.
+func preventPropagation() {
+	prop.cmd = nil
+}
+
+// flushPropagation logs the records of the running command and clears
+// them, along with its changes, so nothing is logged twice.
+func flushPropagation(state *AppState) {
+	for _, rec := range prop.recs {
+		if rec.r == nil {
+			if prop.cmd == nil {
+				continue
+			}
+			rec.r = prop.cmd
+		}
+		logAof(state, DBs[rec.db], rec.r)
+	}
+	prop.recs, prop.dirty = nil, false
+}
+
+// timestamp writes a #TS:<unix> annotation ahead of the next record when
+// aof-timestamp-enabled is set and the clock has moved to another second
+// since the last one. The caller must hold aof.mu.
+func (aof *Aof) timestamp() {
+	if !aof.conf.aofTimestamps {
+		return
+	}
+	if now := time.Now().Unix(); now != aof.ts {
+		fmt.Fprintf(aof.w.writer, "#TS:%d\r\n", now)
+		aof.ts = now
+	}
+}
+
+// selectDB writes a SELECT unless the last record was already for db. The
+// caller must hold aof.mu.
+func (aof *Aof) selectDB(db int) {
+	if aof.db != db {
+		aof.w.Write(cmdResp("SELECT", strconv.Itoa(db)))
+		aof.db = db
+	}
+}
+
+// beginTx starts holding back records until commitTx, so that the writes
+// of an EXEC end up in the AOF as a single MULTI/EXEC block.
+func (aof *Aof) beginTx() {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	aof.tx = []aofRecord{}
+}
+
+// commitTx writes the records held back since beginTx wrapped in MULTI and
+// EXEC. A transaction that wrote nothing leaves no trace.
+func (aof *Aof) commitTx(state *AppState) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	recs := aof.tx
+	aof.tx = nil
+	if len(recs) == 0 {
+		return
+	}
+
+	log.Println("saving aof file")
+	aof.writeTx(recs)
+	if state.conf.aofFSync == Always {
+		aof.w.Flush()
+	}
+}
+
+// writeTx writes recs wrapped in MULTI and EXEC. The caller must hold
+// aof.mu.
+func (aof *Aof) writeTx(recs []aofRecord) {
+	aof.timestamp()
+	aof.selectDB(recs[0].db)
+	aof.w.Write(cmdResp("MULTI"))
+	for _, rec := range recs {
+		aof.selectDB(rec.db)
+		aof.w.Write(rec.r)
+	}
+	aof.w.Write(cmdResp("EXEC"))
+}
+
+func (aof *Aof) Flush() {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	aof.w.Flush()
+}
+
+// startRewrite prepares a rewrite from a snapshot of the databases taken
+// now. It switches logging to a new incremental file, which with those
+// after it then holds exactly the writes the snapshot misses. The caller
+// must hold every database's lock, so no write falls in between.
+func (aof *Aof) startRewrite() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.rewriteFrom > 0 {
+		return errors.New("Background append only file rewriting already in progress")
+	}
+	// BGWRITEAOF inside EXEC: the snapshot holds the transaction's writes
+	// so far, which belong in the old file, and the rest go to the new one
+	if len(aof.tx) > 0 {
+		aof.writeTx(aof.tx)
+		aof.tx = []aofRecord{}
+	}
+	if err := aof.openIncr(); err != nil {
+		return err
+	}
+	aof.rewriteFrom = aof.manifest.incrs[len(aof.manifest.incrs)-1].seq
+	return nil
+}
+
+// Rewrite writes the snapshot taken with startRewrite as a new base file,
+// then replaces the manifest with one listing the new base and the
+// incremental files logged since, and deletes the files they replace.
+// The base is synced and renamed into place before the manifest changes,
+// so a rewrite that fails or is interrupted leaves the old AOF intact.
+func (aof *Aof) Rewrite(cps []map[string]*Item) {
+	aof.mu.Lock()
+	base := aof.manifest.nextBase(aof.conf.aofFn, aof.conf.aofPreamble)
+	from := aof.rewriteFrom
+	aof.mu.Unlock()
+	defer func() {
+		aof.mu.Lock()
+		aof.rewriteFrom = 0
+		aof.mu.Unlock()
+	}()
+
+	tmp := path.Join(aof.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	fp := path.Join(aof.dir, base.name)
+	err := writeAofBase(tmp, cps, aof.conf.aofPreamble)
+	if err == nil {
+		err = os.Rename(tmp, fp)
+	}
+	if err == nil {
+		err = syncDir(aof.dir)
+	}
+	if err != nil {
+		log.Println("aof rewrite error:", err)
+		os.Remove(tmp)
+		return
+	}
+
+	aof.mu.Lock()
+	old := aof.manifest
+	m := &aofManifest{base: &base}
+	for _, incr := range old.incrs {
+		if incr.seq >= from {
+			m.incrs = append(m.incrs, incr)
+		}
+	}
+	err = writeManifest(aof.dir, aof.conf.aofFn, m)
+	if err == nil {
+		aof.manifest = m
+	}
+	aof.mu.Unlock()
+	if err != nil {
+		log.Println("aof rewrite - manifest error:", err)
+		os.Remove(fp)
+		return
+	}
+
+	for _, f := range old.files() {
+		if f.typ == aofBaseType || f.seq < from {
+			os.Remove(path.Join(aof.dir, f.name))
+		}
+	}
+	log.Println("aof rewrite finished:", base.name)
+}
+
+// rdbPreamble marks an AOF file that starts with an RDB encoding of the
+// databases rather than with commands.
+const rdbPreamble = "REDIS-RDB-PREAMBLE\n"
+
+// writeAofBase writes the snapshot cps to the file at fp and syncs it:
+// with preamble, as rdbPreamble followed by the RDB encoding SaveRDB
+// uses, and otherwise as commands, every non-empty database behind a
+// SELECT.
+func writeAofBase(fp string, cps []map[string]*Item, preamble bool) error {
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if preamble {
+		bw := bufio.NewWriter(f)
+		bw.WriteString(rdbPreamble)
+		if err := encodeRDB(bw, cps); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+
+	fwriter := NewWrite(f)
+	for id, cp := range cps {
+		if len(cp) > 0 {
+			fwriter.Write(cmdResp("SELECT", strconv.Itoa(id)))
+		}
+		rewriteDB(fwriter, cp)
+	}
+	if err := fwriter.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// rewriteDB writes one command per key that recreates its value, plus a
+// PEXPIREAT for keys with a TTL.
+func rewriteDB(fwriter *Writer, cp map[string]*Item) {
 	for k, v := range cp {
-		cmd := Resp{sign: BulkString, bulk: "SET"}
-		key := Resp{sign: BulkString, bulk: k}
-		val := Resp{sign: BulkString, bulk: v.V}
+		switch v.Type {
+		case ListType:
+			fwriter.Write(cmdResp(append([]string{"RPUSH", k}, v.L.Values()...)...))
+		case HashType:
+			args := []string{"HSET", k}
+			for f, val := range v.H.m {
+				args = append(args, f, val)
+			}
+			fwriter.Write(cmdResp(args...))
+		case SetType:
+			fwriter.Write(cmdResp(append([]string{"SADD", k}, v.S.Members()...)...))
+		case ZSetType:
+			args := []string{"ZADD", k}
+			for _, e := range v.Z.Entries() {
+				args = append(args, formatFloat(e.score), e.member)
+			}
+			fwriter.Write(cmdResp(args...))
+		case TDigestType:
+			args := []string{"TDIGEST.RESTORE", k, formatFloat(v.T.compression), formatFloat(v.T.min), formatFloat(v.T.max)}
+			for _, c := range v.T.centroids() {
+				args = append(args, formatFloat(c.mean), formatFloat(c.weight))
+			}
+			fwriter.Write(cmdResp(args...))
+		case StreamType:
+			rewriteStream(fwriter, k, v.X)
+		case RoaringType:
+			rewriteRoaring(fwriter, k, v.R)
+		default:
+			fwriter.Write(cmdResp("SET", k, v.V))
+		}
+		if v.hasExpiry() {
+			fwriter.Write(cmdResp("PEXPIREAT", k, strconv.FormatInt(v.Exp.UnixMilli(), 10)))
+		}
+	}
+}
 
-		arr := Resp{sign: Array, arr: []Resp{
-			cmd, key, val,
-		}}
-		fwriter.Write(&arr)
+// rewriteStream writes the entries of a stream, its last ID and its
+// consumer groups, with each pending entry as the XCLAIM that restores its
+// owner, delivery time and count.
+func rewriteStream(fwriter *Writer, k string, s *Stream) {
+	for _, e := range s.entries {
+		fwriter.Write(cmdResp(append([]string{"XADD", k, e.id.String()}, e.fields...)...))
+	}
+	if s.Len() == 0 {
+		// create the key with a placeholder entry that is trimmed at once
+		fwriter.Write(cmdResp("XADD", k, "MAXLEN", "0", "0-1", "x", "y"))
+	}
+	if s.Len() == 0 || s.entries[s.Len()-1].id != s.lastID {
+		fwriter.Write(cmdResp("XSETID", k, s.lastID.String()))
 	}
-	fwriter.Flush()
 
-	// Re-route future AOF records back to file
-	aof.w = NewWrite(aof.f)
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := s.groups[name]
+		fwriter.Write(cmdResp("XGROUP", "CREATE", k, name, g.lastID.String()))
+		for consumer := range g.consumers {
+			fwriter.Write(cmdResp("XGROUP", "CREATECONSUMER", k, name, consumer))
+		}
+		for _, pe := range g.pel {
+			fwriter.Write(cmdResp("XCLAIM", k, name, pe.consumer, "0", pe.id.String(),
+				"TIME", strconv.FormatInt(pe.delivered.UnixMilli(), 10),
+				"RETRYCOUNT", strconv.Itoa(pe.deliveries), "FORCE", "JUSTID"))
+		}
+	}
+}
+
+// roaringRewriteBatch is how many offsets each R.APPENDINTARRAY of a
+// rewritten bitmap carries, so a large bitmap is not one huge command that
+// replay has to parse and hold in memory at once.
+const roaringRewriteBatch = 512
+
+// rewriteRoaring writes a bitmap as R.APPENDINTARRAY commands.
+func rewriteRoaring(fwriter *Writer, k string, rb *RoaringBitmap) {
+	args := []string{"R.APPENDINTARRAY", k}
+	rb.Range(0, math.MaxUint32, func(x uint32) bool {
+		args = append(args, strconv.FormatUint(uint64(x), 10))
+		if len(args)-2 == roaringRewriteBatch {
+			fwriter.Write(cmdResp(args...))
+			args = args[:2]
+		}
+		return true
+	})
+	if len(args) > 2 {
+		fwriter.Write(cmdResp(args...))
+	}
 }
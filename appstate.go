@@ -1,12 +1,16 @@
 package main
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
 type AppState struct {
-	conf          *Config
-	aof           *Aof
-	bgsaveRunning bool
-	dbCopy        map[string]*Item
+	conf *Config
+	aof  *Aof
+	// bgsaveRunning is set while a BGSAVE writes its snapshot. It is
+	// checked and set by concurrent clients, hence atomic.
+	bgsaveRunning atomic.Bool
 }
 
 func NewAppState(conf *Config) *AppState {
@@ -23,7 +27,7 @@ func NewAppState(conf *Config) *AppState {
 				defer t.Stop()
 
 				for range t.C {
-					state.aof.w.Flush()
+					state.aof.Flush()
 				}
 			}()
 		}
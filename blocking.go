@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// blockedClient is a client parked on one or more keys by a blocking
+// command such as BLPOP. Waiters on a key are served in FIFO order.
+type blockedClient struct {
+	keys []string
+	ch   chan *Resp
+	done bool
+
+	// serve runs under db.mu when key k may hold data for the parked
+	// client and produces its reply, or nil to keep waiting.
+	serve func(k string) *Resp
+}
+
+func (db *Database) block(bc *blockedClient) {
+	for _, k := range bc.keys {
+		db.blocked[k] = append(db.blocked[k], bc)
+	}
+}
+
+func (db *Database) unblock(bc *blockedClient) {
+	for _, k := range bc.keys {
+		waiters := db.blocked[k]
+		for i, w := range waiters {
+			if w == bc {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(db.blocked, k)
+		} else {
+			db.blocked[k] = waiters
+		}
+	}
+}
+
+// serveBlocked offers key k to the clients parked on it, oldest first.
+// Each one whose serve produces a reply is woken up; the others, say a
+// BLPOP after an earlier client drained the list, stay parked. The caller
+// must hold db.mu.
+func (db *Database) serveBlocked(k string) {
+	for _, bc := range append([]*blockedClient(nil), db.blocked[k]...) {
+		if bc.done {
+			continue // served by a nested serveBlocked
+		}
+		reply := bc.serve(k)
+		if reply == nil {
+			continue
+		}
+		db.unblock(bc)
+		bc.done = true
+		bc.ch <- reply
+	}
+}
+
+// waitBlocked parks c until bc is served or the timeout expires. A zero
+// timeout waits forever. A client that disconnects meanwhile is unblocked
+// straight away, so no element is popped or delivered on its behalf.
+func (db *Database) waitBlocked(c *Client, bc *blockedClient, timeout time.Duration, state *AppState) *Resp {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	gone, stop := c.watchDisconnect()
+	defer stop()
+
+	// let other commands run while we wait, a write command logging what
+	// it has done so far before theirs
+	if c.writing {
+		flushPropagation(state)
+		execMu.Unlock()
+		defer execMu.Lock()
+	} else {
+		execMu.RUnlock()
+		defer execMu.RLock()
+	}
+
+	select {
+	case reply := <-bc.ch:
+		return reply
+	case <-expired:
+	case <-gone:
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// served while we were waiting for the lock
+	if bc.done {
+		return <-bc.ch
+	}
+	db.unblock(bc)
+	return &Resp{sign: Null}
+}
+
+// watchDisconnect watches c's connection while c is parked, closing gone
+// when the peer goes away. It only peeks through c.rd, so commands the
+// client pipelines meanwhile stay buffered for the command loop; once the
+// buffer fills up the client is clearly alive and the watch ends. stop
+// ends the watch and must be called before c.rd is read again.
+func (c *Client) watchDisconnect() (gone <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	if c.conn == nil {
+		return ch, func() {}
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			_, err := c.rd.Peek(c.rd.Buffered() + 1)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, bufio.ErrBufferFull) {
+				close(ch)
+			}
+			return
+		}
+	}()
+	return ch, func() {
+		// an expired deadline wakes the pending Peek
+		c.conn.SetReadDeadline(time.Now())
+		<-exited
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func parseTimeout(s string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0, errors.New("ERR timeout is not a float or out of range")
+	}
+	if secs < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
@@ -1,15 +1,55 @@
 package main
 
-import "net"
+import (
+	"bufio"
+	"net"
+	"sync"
+)
 
 type Client struct {
 	conn          net.Conn
+	rd            *bufio.Reader // commands are parsed from conn through rd
 	authenticated bool
 	tx            *Transaction
+	db            int     // index into DBs selected with SELECT
+	watches       []watch // keys WATCHed for the next EXEC
+	writing       bool    // running a write command, see runIsolated
+
+	// pub/sub state, see pubsub.go
+	channels map[string]bool
+	patterns map[string]bool
+	mu       sync.Mutex
+	out      chan *Resp
 }
 
 func NewClient(conn net.Conn) *Client {
-	return &Client{
-		conn: conn,
+	c := &Client{
+		conn:     conn,
+		channels: map[string]bool{},
+		patterns: map[string]bool{},
+	}
+	if conn != nil {
+		c.rd = bufio.NewReader(conn)
+	}
+	return c
+}
+
+// NewReplayClient returns the client AOF records are replayed on behalf
+// of. It has no connection and needs no authentication.
+func NewReplayClient() *Client {
+	c := NewClient(nil)
+	c.authenticated = true
+	return c
+}
+
+// send writes a reply to the client. Once the client has used pub/sub it
+// goes through the client's queue, behind any pending messages.
+func (c *Client) send(r *Resp) {
+	if c.pushing() {
+		c.deliver(r)
+		return
 	}
+	w := NewWrite(c.conn)
+	w.Write(r)
+	w.Flush()
 }
@@ -15,6 +15,9 @@ type Config struct {
 	rdbFn          string
 	aofEnabled     bool
 	aofFn          string
+	aofDirName     string
+	aofPreamble    bool
+	aofTimestamps  bool
 	aofFSync       FSyncMode
 	requirepass    bool
 	password       string
@@ -24,6 +27,12 @@ type Config struct {
 	maxCommandArgs int
 	eviction       Eviction
 	memSamples     int
+
+	hz                 int
+	activeExpireEffort int
+	databases          int
+
+	notifyKeyspaceEvents int // notify* class bits, see notify.go
 }
 
 func NewConfig() *Config {
@@ -47,6 +56,13 @@ const (
 	defaultMaxBulkSize    = 8 * 1024 * 1024 // 8MB
 	defaultMaxCommandSize = 1 * 1024 * 1024 // 1MB
 	defaultMaxCommandArgs = 256
+
+	defaultHz                 = 10
+	defaultActiveExpireEffort = 1
+	defaultDatabases          = 16
+
+	defaultAofFn      = "appendonly.aof"
+	defaultAofDirName = "appendonlydir"
 )
 
 type Eviction string
@@ -97,6 +113,23 @@ func readConf(fn string) *Config {
 	if conf.maxCommandArgs <= 0 {
 		conf.maxCommandArgs = defaultMaxCommandArgs
 	}
+	if conf.hz <= 0 {
+		conf.hz = defaultHz
+	}
+	conf.hz = min(conf.hz, 500)
+	if conf.activeExpireEffort <= 0 {
+		conf.activeExpireEffort = defaultActiveExpireEffort
+	}
+	conf.activeExpireEffort = min(conf.activeExpireEffort, 10)
+	if conf.databases <= 0 {
+		conf.databases = defaultDatabases
+	}
+	if conf.aofFn == "" {
+		conf.aofFn = defaultAofFn
+	}
+	if conf.aofDirName == "" {
+		conf.aofDirName = defaultAofDirName
+	}
 	return conf
 }
 
@@ -133,12 +166,21 @@ func parseLine(l string, conf *Config) {
 	case "appendfilename":
 		conf.aofFn = args[1]
 
+	case "appenddirname":
+		conf.aofDirName = args[1]
+
 	case "dir":
 		conf.dir = args[1]
 
 	case "appendonly":
 		conf.aofEnabled = args[1] == "yes"
 
+	case "aof-use-rdb-preamble":
+		conf.aofPreamble = args[1] == "yes"
+
+	case "aof-timestamp-enabled":
+		conf.aofTimestamps = args[1] == "yes"
+
 	case "appendfsync":
 		conf.aofFSync = FSyncMode(args[1])
 
@@ -193,6 +235,46 @@ func parseLine(l string, conf *Config) {
 			break
 		}
 		conf.memSamples = memSamples
+
+	case "hz":
+		hz, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Println("cannot parse hz. defaulting to 10. error:", err)
+			conf.hz = defaultHz
+			break
+		}
+		conf.hz = hz
+
+	case "active-expire-effort":
+		effort, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Println("cannot parse active-expire-effort. defaulting to 1. error:", err)
+			conf.activeExpireEffort = defaultActiveExpireEffort
+			break
+		}
+		conf.activeExpireEffort = effort
+
+	case "databases":
+		databases, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Println("cannot parse databases. defaulting to 16. error:", err)
+			conf.databases = defaultDatabases
+			break
+		}
+		conf.databases = databases
+
+	case "notify-keyspace-events":
+		var v string
+		if len(args) > 1 {
+			v = strings.Trim(args[1], `"`)
+		}
+		flags, err := parseNotifyFlags(v)
+		if err != nil {
+			log.Println("cannot parse notify-keyspace-events. notifications stay disabled. error:", err)
+			conf.notifyKeyspaceEvents = 0
+			break
+		}
+		conf.notifyKeyspaceEvents = flags
 	}
 }
 
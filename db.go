@@ -9,15 +9,27 @@ import (
 )
 
 type Database struct {
-	store map[string]*Item
-	mu    sync.RWMutex
-	mem   int64
+	id      int
+	store   map[string]*Item
+	expires *HashSet   // keys carrying a TTL, sampled by the active expire cycle
+	scanIdx *skiplist  // every key ordered by scanHash, walked by SCAN
+	keyIdx  *radixTree // every key in lexicographic order, walked by KEYS
+	mu      sync.RWMutex
+	mem     int64
+	blocked map[string][]*blockedClient
+	watched map[string]*watchedKey // keys WATCHed by some client
 }
 
-func NewDatabase() *Database {
+func NewDatabase(id int) *Database {
 	return &Database{
-		store: map[string]*Item{},
-		mu:    sync.RWMutex{},
+		id:      id,
+		store:   map[string]*Item{},
+		expires: NewHashSet(),
+		scanIdx: newSkiplist(),
+		keyIdx:  newRadixTree(),
+		mu:      sync.RWMutex{},
+		blocked: map[string][]*blockedClient{},
+		watched: map[string]*watchedKey{},
 	}
 }
 
@@ -26,7 +38,7 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 		return errors.New("maximum memory reached")
 	}
 
-	samples := sampleKeys(state)
+	samples := sampleKeys(db, state)
 
 	enoughMemFreed := func() bool {
 		if db.mem+requiredMem < state.conf.maxmem {
@@ -39,7 +51,11 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 	evictUntilMemFreed := func(samples []sample) {
 		for _, s := range samples {
 			log.Println("evicting key: ", s.k)
-			db.Delete(s.k)
+			db.remove(s.k)
+			db.notify(notifyEvicted, "evicted", s.k)
+			// a DEL keeps the evicted key from coming back on restart
+			alsoPropagate(db, cmdResp("DEL", s.k))
+			ServerStats.evictedKeys.Add(1)
 			if enoughMemFreed() {
 				break
 			}
@@ -67,17 +83,29 @@ func (db *Database) evictKeys(state *AppState, requiredMem int64) error {
 
 func (db *Database) tryExpire(k string, item *Item) bool {
 	if item.shouldExpire() {
-		DB.mu.Lock()
-		DB.Delete(k)
-		DB.mu.Unlock()
+		db.remove(k)
+		db.notify(notifyExpired, "expired", k)
+		ServerStats.expiredKeys.Add(1)
 		return true
 	}
 	return false
 }
 
+// SetExpiry sets the expiry of the item stored at k, where a zero time
+// removes it. All expiry changes go through here so the expires index
+// stays in step with the keyspace. The caller must hold db.mu.
+func (db *Database) SetExpiry(k string, item *Item, exp time.Time) {
+	item.Exp = exp
+	if item.hasExpiry() {
+		db.expires.Add(k)
+	} else {
+		db.expires.Remove(k)
+	}
+}
+
+// Get returns the live item stored at k, reclaiming it first if it has
+// expired. The caller must hold db.mu for writing.
 func (db *Database) Get(k string) (i *Item, ok bool) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
 	item, ok := db.store[k]
 	if !ok {
 		return item, ok
@@ -94,30 +122,97 @@ func (db *Database) Get(k string) (i *Item, ok bool) {
 	return item, ok
 }
 
+// peek is the read-only counterpart of Get for callers holding only a
+// read lock: expired items are reported as missing but left in place.
+func (db *Database) peek(k string) (*Item, bool) {
+	item, ok := db.store[k]
+	if !ok || item.shouldExpire() {
+		return nil, false
+	}
+	return item, true
+}
+
+// ensureMem makes room for requiredMem more bytes, evicting keys according
+// to the configured policy when maxmemory would be exceeded.
+func (db *Database) ensureMem(state *AppState, requiredMem int64) error {
+	outOfMem := state.conf.maxmem > 0 && db.mem+requiredMem > state.conf.maxmem
+	if outOfMem {
+		return db.evictKeys(state, requiredMem)
+	}
+	return nil
+}
+
 func (db *Database) Set(k, v string, state *AppState) error {
 	if old, ok := db.store[k]; ok {
 		oldmem := old.approxMemUsage(k)
 		db.mem -= oldmem
 	}
 
-	key := &Item{V: v}
+	key := &Item{V: v, LastAccess: time.Now()}
 	kmem := key.approxMemUsage(k)
 
-	outOfMem := state.conf.maxmem > 0 && db.mem+kmem > state.conf.maxmem
-	if outOfMem {
-		err := db.evictKeys(state, kmem)
-		if err != nil {
-			return err
-		}
+	if err := db.ensureMem(state, kmem); err != nil {
+		return err
 	}
 
+	_, exists := db.store[k]
+	if !exists {
+		db.scanIdx.insert(scanHash(k), k)
+		db.keyIdx.insert(k)
+	}
 	db.store[k] = key
+	db.expires.Remove(k)
 	db.mem += kmem
 	log.Println("mem", db.mem)
+	if !exists {
+		db.notify(notifyNew, "new", k)
+	}
 	return nil
 }
 
+// Put stores item at k, replacing any existing value. Callers check the
+// memory limit with ensureMem before they start writing.
+func (db *Database) Put(k string, item *Item) {
+	if old, ok := db.store[k]; ok {
+		db.mem -= old.approxMemUsage(k)
+	} else {
+		db.scanIdx.insert(scanHash(k), k)
+		db.keyIdx.insert(k)
+		defer db.notify(notifyNew, "new", k)
+	}
+	if item.LastAccess.IsZero() {
+		item.LastAccess = time.Now()
+	}
+	db.store[k] = item
+	db.SetExpiry(k, item, item.Exp)
+	db.mem += item.approxMemUsage(k)
+}
+
+// Update runs fn against the item stored at k and keeps the memory
+// accounting in step with whatever fn changed. Containers left empty by fn
+// are removed from the keyspace with a del event, so fn reports its own
+// event to keep them in order.
+func (db *Database) Update(k string, item *Item, fn func()) {
+	before := item.approxMemUsage(k)
+	fn()
+	db.mem += item.approxMemUsage(k) - before
+
+	if item.empty() {
+		db.Delete(k)
+	}
+}
+
+// Delete removes k and reports it with a del event.
 func (db *Database) Delete(k string) {
+	if _, ok := db.store[k]; ok {
+		db.remove(k)
+		db.notify(notifyGeneric, "del", k)
+	}
+}
+
+// remove drops k from the keyspace without an event, for callers that
+// report a more specific one, such as expired or rename_from.
+func (db *Database) remove(k string) {
 	key, ok := db.store[k]
 	if !ok {
 		return // fail gracefully
@@ -125,7 +220,93 @@ func (db *Database) Delete(k string) {
 	kmem := key.approxMemUsage(k)
 
 	delete(db.store, k)
+	db.expires.Remove(k)
+	db.scanIdx.delete(scanHash(k), k)
+	db.keyIdx.delete(k)
 	db.mem -= kmem
 }
 
-var DB = NewDatabase()
+// reindex rebuilds the memory total and the key indexes from the store,
+// after it has been replaced wholesale by loading an RDB file or a flush.
+func (db *Database) reindex() {
+	db.mem = 0
+	db.expires = NewHashSet()
+	db.scanIdx = newSkiplist()
+	db.keyIdx = newRadixTree()
+	for k, item := range db.store {
+		db.mem += item.approxMemUsage(k)
+		db.scanIdx.insert(scanHash(k), k)
+		db.keyIdx.insert(k)
+		if item.hasExpiry() {
+			db.expires.Add(k)
+		}
+	}
+}
+
+// DBs holds the numbered logical databases clients switch between with
+// SELECT. Its size comes from the databases setting.
+var DBs []*Database
+
+func InitDatabases(n int) {
+	DBs = make([]*Database, n)
+	for i := range DBs {
+		DBs[i] = NewDatabase(i)
+	}
+}
+
+// lockDBs write-locks two databases in index order, so commands spanning
+// databases cannot deadlock, and returns the matching unlock. a and b may
+// be the same database, which is then locked once.
+func lockDBs(a, b *Database) func() {
+	if a == b {
+		a.mu.Lock()
+		return a.mu.Unlock
+	}
+	if a.id > b.id {
+		a, b = b, a
+	}
+	a.mu.Lock()
+	b.mu.Lock()
+	return func() {
+		b.mu.Unlock()
+		a.mu.Unlock()
+	}
+}
+
+// rlockDBs read-locks every database in index order and returns the
+// matching unlock. Writers log to the AOF while holding their database's
+// lock, so nothing is written or logged until the unlock.
+func rlockDBs() func() {
+	for _, db := range DBs {
+		db.mu.RLock()
+	}
+	return func() {
+		for i := len(DBs) - 1; i >= 0; i-- {
+			DBs[i].mu.RUnlock()
+		}
+	}
+}
+
+// snapshotDBs copies every database's keyspace for the background RDB and
+// AOF writers, as of one point in time.
+func snapshotDBs() []map[string]*Item {
+	unlock := rlockDBs()
+	defer unlock()
+	return copyDBs()
+}
+
+// copyDBs deep copies every database's keyspace, since containers are
+// edited in place. The caller must hold every database's lock.
+func copyDBs() []map[string]*Item {
+	cps := make([]map[string]*Item, len(DBs))
+	for i, db := range DBs {
+		cp := make(map[string]*Item, len(db.store))
+		for k, item := range db.store {
+			c := item.clone()
+			c.LastAccess, c.AccessCount = item.LastAccess, item.AccessCount
+			cp[k] = c
+		}
+		cps[i] = cp
+	}
+	return cps
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Active expiry, modelled on Redis's activeExpireCycle. Lazy expiry in
+// Database.Get only reclaims keys somebody reads, so hz times a second we
+// sample keys carrying a TTL and delete the expired ones. While more than
+// an acceptable share of the sample turns out stale we keep going, within
+// a CPU budget per cycle. active-expire-effort (1-10) scales the sample
+// size, the acceptable stale share and the budget.
+const (
+	activeExpireKeysPerLoop     = 20 // keys sampled per loop at effort 1
+	activeExpireAcceptableStale = 10 // % of stale keys that ends a cycle at effort 1
+	activeExpireSlowTimePerc    = 25 // % of each 1/hz slot a cycle may use at effort 1
+)
+
+func InitActiveExpire(state *AppState) {
+	go func() {
+		t := time.NewTicker(time.Second / time.Duration(state.conf.hz))
+		defer t.Stop()
+
+		for range t.C {
+			activeExpireCycle(state)
+		}
+	}()
+}
+
+func activeExpireCycle(state *AppState) {
+	effort := state.conf.activeExpireEffort - 1 // 0..9
+	keysPerLoop := activeExpireKeysPerLoop + activeExpireKeysPerLoop/4*effort
+	acceptableStale := activeExpireAcceptableStale - effort
+	timeLimit := time.Second * time.Duration(activeExpireSlowTimePerc+2*effort) / 100 / time.Duration(state.conf.hz)
+
+	start := time.Now()
+	defer func() {
+		ServerStats.expireCycleCount.Add(1)
+		ServerStats.expireCycleTime.Add(time.Since(start).Microseconds())
+	}()
+
+	// keys must not expire in the middle of a transaction
+	execMu.RLock()
+	defer execMu.RUnlock()
+
+	deadline := start.Add(timeLimit)
+	for _, db := range DBs {
+		if !db.activeExpire(keysPerLoop, acceptableStale, deadline) {
+			ServerStats.expiredTimeCapReached.Add(1)
+			log.Println("active expire cycle reached its time limit")
+			return
+		}
+	}
+}
+
+// activeExpire keeps sampling db while more than acceptableStale percent
+// of each sample turns out expired. It returns false when it had to stop
+// because the cycle ran past deadline.
+func (db *Database) activeExpire(keysPerLoop, acceptableStale int, deadline time.Time) bool {
+	for {
+		sampled, expired := db.expireSample(keysPerLoop)
+		if sampled == 0 {
+			return true
+		}
+
+		// running average of the stale share, weighted like Redis does
+		perc := int64(expired * 100 / sampled)
+		avg := ServerStats.expiredStalePerc.Load()
+		ServerStats.expiredStalePerc.Store((perc*5 + avg*95) / 100)
+
+		if time.Now().After(deadline) {
+			return false
+		}
+		if expired*100/sampled <= acceptableStale {
+			return true
+		}
+	}
+}
+
+// expireSample checks up to n random keys carrying a TTL and deletes the
+// expired ones. It returns how many keys were sampled and expired.
+func (db *Database) expireSample(n int) (sampled, expired int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n = min(n, db.expires.Len())
+	for range n {
+		if db.expires.Len() == 0 {
+			break
+		}
+		k := db.expires.Random()
+		sampled++
+		if db.tryExpire(k, db.store[k]) {
+			expired++
+		}
+	}
+	return sampled, expired
+}
@@ -1,34 +1,273 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	"maps"
+	"math"
+	"math/rand"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Handler func(*Client, *Resp, *AppState) *Resp
 
 var Handlers = map[string]Handler{
-	"SET":        set,
-	"GET":        get,
-	"DEL":        del,
-	"COMMAND":    command,
-	"EXISTS":     exists,
-	"KEYS":       keys,
-	"SAVE":       save,
-	"BGSAVE":     bgsave,
-	"DBSIZE":     dbsize,
-	"FLUSHDB":    flushdb,
-	"AUTH":       auth,
-	"EXPIRE":     expire,
-	"TTL":        ttl,
-	"BGWRITEAOF": bgwriteaof,
-	"MULTI":      multi,
-	"EXEC":       _exec,
-	"DISCARD":    discard,
+	"SET":          set,
+	"GET":          get,
+	"DEL":          del,
+	"COMMAND":      command,
+	"EXISTS":       exists,
+	"KEYS":         keys,
+	"SAVE":         save,
+	"BGSAVE":       bgsave,
+	"DBSIZE":       dbsize,
+	"FLUSHDB":      flushdb,
+	"AUTH":         auth,
+	"EXPIRE":       expire,
+	"TTL":          ttl,
+	"PEXPIRE":      pexpire,
+	"EXPIREAT":     expireat,
+	"PEXPIREAT":    pexpireat,
+	"PTTL":         pttl,
+	"EXPIRETIME":   expiretime,
+	"PEXPIRETIME":  pexpiretime,
+	"PERSIST":      persist,
+	"BGWRITEAOF":   bgwriteaof,
+	"MULTI":        multi,
+	"EXEC":         _exec,
+	"DISCARD":      discard,
+	"WATCH":        watchCmd,
+	"UNWATCH":      unwatch,
+	"LPUSH":        lpush,
+	"RPUSH":        rpush,
+	"LPOP":         lpop,
+	"RPOP":         rpop,
+	"LLEN":         llen,
+	"LRANGE":       lrange,
+	"LINDEX":       lindex,
+	"LSET":         lset,
+	"LREM":         lrem,
+	"LTRIM":        ltrim,
+	"LINSERT":      linsert,
+	"LMOVE":        lmove,
+	"BLPOP":        blpop,
+	"BRPOP":        brpop,
+	"BLMOVE":       blmove,
+	"HSET":         hset,
+	"HMSET":        hset,
+	"HSETNX":       hsetnx,
+	"HGET":         hget,
+	"HMGET":        hmget,
+	"HDEL":         hdel,
+	"HGETALL":      hgetall,
+	"HKEYS":        hkeys,
+	"HVALS":        hvals,
+	"HLEN":         hlen,
+	"HEXISTS":      hexists,
+	"HINCRBY":      hincrby,
+	"HINCRBYFLOAT": hincrbyfloat,
+	"SADD":         sadd,
+	"SREM":         srem,
+	"SMEMBERS":     smembers,
+	"SISMEMBER":    sismember,
+	"SMISMEMBER":   smismember,
+	"SCARD":        scard,
+	"SPOP":         spop,
+	"SRANDMEMBER":  srandmember,
+	"SINTER":       sinter,
+	"SUNION":       sunion,
+	"SDIFF":        sdiff,
+	"SINTERSTORE":  sinterstore,
+	"SUNIONSTORE":  sunionstore,
+	"SDIFFSTORE":   sdiffstore,
+	"ZADD":         zadd,
+	"ZINCRBY":      zincrby,
+	"ZSCORE":       zscore,
+	"ZCARD":        zcard,
+	"ZRANK":        zrank,
+	"ZREVRANK":     zrevrank,
+	"ZREM":         zrem,
+	"ZCOUNT":       zcount,
+	"ZRANGE":       zrange,
+	"ZPOPMIN":      zpopmin,
+	"ZPOPMAX":      zpopmax,
+	"ZUNIONSTORE":  zunionstore,
+	"ZINTERSTORE":  zinterstore,
+	"MGET":         mget,
+	"MSET":         mset,
+	"MSETNX":       msetnx,
+	"SETNX":        setnx,
+	"SETEX":        setex,
+	"PSETEX":       setex,
+	"GETSET":       getset,
+	"GETDEL":       getdel,
+	"GETEX":        getex,
+	"APPEND":       appendCmd,
+	"STRLEN":       strlen,
+	"GETRANGE":     getrange,
+	"SETRANGE":     setrange,
+	"INCR":         incr,
+	"DECR":         decr,
+	"INCRBY":       incrby,
+	"DECRBY":       decrby,
+	"INCRBYFLOAT":  incrbyfloat,
+	"INFO":         info,
+	"KEYSPREFIX":   keysprefix,
+	"SCAN":         scanCmd,
+	"TYPE":         typeCmd,
+	"RENAME":       rename,
+	"RENAMENX":     renamenx,
+	"COPY":         copyCmd,
+	"RANDOMKEY":    randomkey,
+	"TOUCH":        touch,
+	"UNLINK":       del,
+	"OBJECT":       object,
+	"SELECT":       selectCmd,
+	"MOVE":         move,
+	"SWAPDB":       swapdb,
+	"FLUSHALL":     flushall,
+	"PING":         ping,
+	"SUBSCRIBE":    subscribe,
+	"UNSUBSCRIBE":  unsubscribe,
+	"PSUBSCRIBE":   psubscribe,
+	"PUNSUBSCRIBE": punsubscribe,
+	"PUBLISH":      publish,
+	"PUBSUB":       pubsub,
+
+	"TDIGEST.CREATE":       tdigestCreate,
+	"TDIGEST.ADD":          tdigestAdd,
+	"TDIGEST.RESET":        tdigestReset,
+	"TDIGEST.MERGE":        tdigestMerge,
+	"TDIGEST.QUANTILE":     tdigestQuantile,
+	"TDIGEST.CDF":          tdigestCDF,
+	"TDIGEST.RANK":         tdigestRankCmd,
+	"TDIGEST.REVRANK":      tdigestRevRankCmd,
+	"TDIGEST.BYRANK":       tdigestByRankCmd,
+	"TDIGEST.BYREVRANK":    tdigestByRevRankCmd,
+	"TDIGEST.MIN":          tdigestMin,
+	"TDIGEST.MAX":          tdigestMax,
+	"TDIGEST.TRIMMED_MEAN": tdigestTrimmedMean,
+	"TDIGEST.INFO":         tdigestInfo,
+	"TDIGEST.RESTORE":      tdigestRestore,
+
+	"XADD":       xadd,
+	"XRANGE":     xrange,
+	"XREVRANGE":  xrevrange,
+	"XLEN":       xlen,
+	"XDEL":       xdel,
+	"XTRIM":      xtrim,
+	"XSETID":     xsetid,
+	"XREAD":      xread,
+	"XGROUP":     xgroup,
+	"XREADGROUP": xreadgroup,
+	"XACK":       xack,
+	"XPENDING":   xpending,
+	"XCLAIM":     xclaim,
+	"XAUTOCLAIM": xautoclaim,
+
+	"R.SETBIT":         rsetbit,
+	"R.GETBIT":         rgetbit,
+	"R.CARD":           rcard,
+	"R.RANGE":          rrange,
+	"R.BITOP":          rbitop,
+	"R.APPENDINTARRAY": rappendintarray,
+}
+
+// Arities gives the number of arguments each command takes, counting the
+// command name, as Redis does: N means exactly N and -N at least N. It is
+// checked before a command runs or is queued in a transaction, so a
+// malformed command aborts the transaction instead of failing inside EXEC.
+var Arities = map[string]int{
+	"SET": -3, "GET": 2, "DEL": -2, "COMMAND": -1, "EXISTS": -2, "KEYS": 2,
+	"SAVE": 1, "BGSAVE": -1, "DBSIZE": 1, "FLUSHDB": -1, "AUTH": 2,
+	"EXPIRE": -3, "TTL": 2, "PEXPIRE": -3, "EXPIREAT": -3, "PEXPIREAT": -3,
+	"PTTL": 2, "EXPIRETIME": 2, "PEXPIRETIME": 2, "PERSIST": 2,
+	"BGWRITEAOF": 1, "MULTI": 1, "EXEC": 1, "DISCARD": 1, "WATCH": -2,
+	"UNWATCH": 1,
+
+	"LPUSH": -3, "RPUSH": -3, "LPOP": -2, "RPOP": -2, "LLEN": 2,
+	"LRANGE": 4, "LINDEX": 3, "LSET": 4, "LREM": 4, "LTRIM": 4,
+	"LINSERT": 5, "LMOVE": 5, "BLPOP": -3, "BRPOP": -3, "BLMOVE": 6,
+
+	"HSET": -4, "HMSET": -4, "HSETNX": 4, "HGET": 3, "HMGET": -3,
+	"HDEL": -3, "HGETALL": 2, "HKEYS": 2, "HVALS": 2, "HLEN": 2,
+	"HEXISTS": 3, "HINCRBY": 4, "HINCRBYFLOAT": 4,
+
+	"SADD": -3, "SREM": -3, "SMEMBERS": 2, "SISMEMBER": 3,
+	"SMISMEMBER": -3, "SCARD": 2, "SPOP": -2, "SRANDMEMBER": -2,
+	"SINTER": -2, "SUNION": -2, "SDIFF": -2, "SINTERSTORE": -3,
+	"SUNIONSTORE": -3, "SDIFFSTORE": -3,
+
+	"ZADD": -4, "ZINCRBY": 4, "ZSCORE": 3, "ZCARD": 2, "ZRANK": 3,
+	"ZREVRANK": 3, "ZREM": -3, "ZCOUNT": 4, "ZRANGE": -4, "ZPOPMIN": -2,
+	"ZPOPMAX": -2, "ZUNIONSTORE": -4, "ZINTERSTORE": -4,
+
+	"MGET": -2, "MSET": -3, "MSETNX": -3, "SETNX": 3, "SETEX": 4,
+	"PSETEX": 4, "GETSET": 3, "GETDEL": 2, "GETEX": -2, "APPEND": 3,
+	"STRLEN": 2, "GETRANGE": 4, "SETRANGE": 4, "INCR": 2, "DECR": 2,
+	"INCRBY": 3, "DECRBY": 3, "INCRBYFLOAT": 3,
+
+	"INFO": -1, "KEYSPREFIX": -2, "SCAN": -2, "TYPE": 2, "RENAME": 3,
+	"RENAMENX": 3, "COPY": -3, "RANDOMKEY": 1, "TOUCH": -2, "UNLINK": -2,
+	"OBJECT": -2, "SELECT": 2, "MOVE": 3, "SWAPDB": 3, "FLUSHALL": -1,
+
+	"PING": -1, "SUBSCRIBE": -2, "UNSUBSCRIBE": -1, "PSUBSCRIBE": -2,
+	"PUNSUBSCRIBE": -1, "PUBLISH": 3, "PUBSUB": -2,
+
+	"TDIGEST.CREATE": -2, "TDIGEST.ADD": -3, "TDIGEST.RESET": 2,
+	"TDIGEST.MERGE": -4, "TDIGEST.QUANTILE": -3, "TDIGEST.CDF": -3,
+	"TDIGEST.RANK": -3, "TDIGEST.REVRANK": -3, "TDIGEST.BYRANK": -3,
+	"TDIGEST.BYREVRANK": -3, "TDIGEST.MIN": 2, "TDIGEST.MAX": 2,
+	"TDIGEST.TRIMMED_MEAN": 4, "TDIGEST.INFO": 2, "TDIGEST.RESTORE": -5,
+
+	"XADD": -5, "XRANGE": -4, "XREVRANGE": -4, "XLEN": 2, "XDEL": -3,
+	"XTRIM": -4, "XSETID": -3, "XREAD": -4, "XGROUP": -2, "XREADGROUP": -7,
+	"XACK": -4, "XPENDING": -3, "XCLAIM": -6, "XAUTOCLAIM": -6,
+
+	"R.SETBIT": 4, "R.GETBIT": 3, "R.CARD": 2, "R.RANGE": -4, "R.BITOP": -4,
+	"R.APPENDINTARRAY": -3,
+}
+
+// Writes lists the commands that may change the dataset. They run one at
+// a time, holding execMu exclusively, and call logs them to the AOF.
+var Writes = map[string]bool{
+	"SET": true, "DEL": true, "UNLINK": true, "FLUSHDB": true, "FLUSHALL": true,
+	"EXPIRE": true, "PEXPIRE": true, "EXPIREAT": true, "PEXPIREAT": true,
+	"PERSIST": true, "RENAME": true, "RENAMENX": true, "COPY": true,
+	"MOVE": true, "SWAPDB": true,
+
+	"LPUSH": true, "RPUSH": true, "LPOP": true, "RPOP": true, "LSET": true,
+	"LREM": true, "LTRIM": true, "LINSERT": true, "LMOVE": true,
+	"BLPOP": true, "BRPOP": true, "BLMOVE": true,
+
+	"HSET": true, "HMSET": true, "HSETNX": true, "HDEL": true,
+	"HINCRBY": true, "HINCRBYFLOAT": true,
+
+	"SADD": true, "SREM": true, "SPOP": true, "SINTERSTORE": true,
+	"SUNIONSTORE": true, "SDIFFSTORE": true,
+
+	"ZADD": true, "ZINCRBY": true, "ZREM": true, "ZPOPMIN": true,
+	"ZPOPMAX": true, "ZUNIONSTORE": true, "ZINTERSTORE": true,
+
+	"MSET": true, "MSETNX": true, "SETNX": true, "SETEX": true,
+	"PSETEX": true, "GETSET": true, "GETDEL": true, "GETEX": true,
+	"APPEND": true, "SETRANGE": true, "INCR": true, "DECR": true,
+	"INCRBY": true, "DECRBY": true, "INCRBYFLOAT": true,
+
+	"TDIGEST.CREATE": true, "TDIGEST.ADD": true, "TDIGEST.RESET": true,
+	"TDIGEST.MERGE": true, "TDIGEST.RESTORE": true,
+
+	"XADD": true, "XDEL": true, "XTRIM": true, "XSETID": true,
+	"XGROUP": true, "XREADGROUP": true, "XACK": true, "XCLAIM": true,
+	"XAUTOCLAIM": true,
+
+	"R.SETBIT": true, "R.BITOP": true, "R.APPENDINTARRAY": true,
 }
+
 var SafeCMDs = []string{
 	"AUTH",
 	"auth",
@@ -38,39 +277,117 @@ var SafeCMDs = []string{
 func handle(c *Client, r *Resp, state *AppState) {
 	cmd := r.arr[0].bulk
 	handler, ok := Handlers[cmd]
-	w := NewWrite(c.conn)
 	if !ok {
-		w.Write(&Resp{
+		if c.tx != nil {
+			c.tx.aborted = true
+		}
+		c.send(&Resp{
 			sign: Error,
 			err:  "ERR invalid command",
 		})
-		w.Flush()
 		return
 	}
 
 	if state.conf.requirepass && !c.authenticated && !contains(SafeCMDs, cmd) {
-		w.Write(&Resp{
+		c.send(&Resp{
 			sign: Error,
 			err:  "ERR operation not permitted",
 		})
-		w.Flush()
+		return
+	}
+
+	if c.subscriptions() > 0 && !contains(subModeCmds, strings.ToUpper(cmd)) {
+		c.send(&Resp{
+			sign: Error,
+			err:  "ERR Can't execute '" + strings.ToLower(cmd) + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context",
+		})
+		return
+	}
+
+	if !checkArity(cmd, len(r.arr)) {
+		if c.tx != nil {
+			c.tx.aborted = true
+		}
+		c.send(argsErr(strings.ToUpper(cmd)))
 		return
 	}
 
 	if c.tx != nil && cmd != "EXEC" && cmd != "DISCARD" {
-		txCmd := TxCommand{r: r, handler: handler}
+		if contains(subscribeCmds, strings.ToUpper(cmd)) {
+			c.send(&Resp{
+				sign: Error,
+				err:  "ERR Command not allowed inside a transaction",
+			})
+			return
+		}
+		if strings.ToUpper(cmd) == "WATCH" {
+			c.send(&Resp{
+				sign: Error,
+				err:  "ERR WATCH inside MULTI is not allowed",
+			})
+			return
+		}
+		txCmd := TxCommand{cmd: cmd, r: r, handler: handler}
 		c.tx.cmds = append(c.tx.cmds, &txCmd)
-		w.Write(&Resp{
+		c.send(&Resp{
 			sign: SimpleString,
 			str:  "QUEUED",
 		})
-		w.Flush()
 		return
 	}
 
+	// pub/sub commands queue their own replies
+	reply := runIsolated(cmd, handler, c, r, state)
+	if reply == nil {
+		return
+	}
+	c.send(reply)
+}
+
+// runIsolated runs handler under execMu: exclusively for EXEC, so a
+// transaction never interleaves with other clients, and for write
+// commands, so they reach the AOF in the order they were applied, and
+// shared for every other command. Blocking commands let go of it while
+// they wait.
+func runIsolated(cmd string, handler Handler, c *Client, r *Resp, state *AppState) *Resp {
+	if cmd == "EXEC" || Writes[cmd] {
+		execMu.Lock()
+		defer execMu.Unlock()
+	} else {
+		execMu.RLock()
+		defer execMu.RUnlock()
+	}
+	return call(cmd, handler, c, r, state)
+}
+
+// call runs handler and, when cmd is a write command that changed the
+// dataset, logs it to the AOF, see propagation. Write commands must hold
+// execMu exclusively.
+func call(cmd string, handler Handler, c *Client, r *Resp, state *AppState) *Resp {
+	if !Writes[cmd] {
+		return handler(c, r, state)
+	}
+	prop = propagation{db: c.db, cmd: r}
+	c.writing = true
 	reply := handler(c, r, state)
-	w.Write(reply)
-	w.Flush()
+	c.writing = false
+	flushPropagation(state)
+	prop = propagation{}
+	return reply
+}
+
+// checkArity reports whether n, the length of a command including its
+// name, fits the command's entry in Arities. Commands without an entry
+// check their arguments themselves.
+func checkArity(cmd string, n int) bool {
+	arity, ok := Arities[cmd]
+	if !ok {
+		return true
+	}
+	if arity < 0 {
+		return n >= -arity
+	}
+	return n == arity
 }
 
 func command(c *Client, r *Resp, state *AppState) *Resp {
@@ -80,9 +397,12 @@ func command(c *Client, r *Resp, state *AppState) *Resp {
 	}
 }
 
+// set implements SET key value [NX | XX] [GET] [EX s | PX ms | EXAT ts |
+// PXAT ms-ts | KEEPTTL].
 func set(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
 	args := r.arr[1:]
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return &Resp{
 			sign: Error,
 			err:  "ERR invalid args for 'SET'",
@@ -91,33 +411,86 @@ func set(c *Client, r *Resp, state *AppState) *Resp {
 	k := args[0].bulk
 	v := args[1].bulk
 
-	DB.mu.Lock()
-	err := DB.Set(k, v, state)
+	var nx, xx, get, keepTTL, hasExp bool
+	var exp time.Time
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExp || i+1 >= len(args) {
+				return syntaxErr()
+			}
+			n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return notIntErr()
+			}
+			t, ok := expiryAt(opt, n)
+			if n <= 0 || !ok {
+				return errResp("ERR invalid expire time in 'set' command")
+			}
+			exp, hasExp = t, true
+			i++
+		default:
+			return syntaxErr()
+		}
+	}
+	if (nx && xx) || (keepTTL && hasExp) {
+		return syntaxErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, exists := db.Get(k)
+	if get && exists && old.Type != StringType {
+		return wrongTypeErr()
+	}
+
+	// the reply for GET, also sent when NX / XX stop the write
+	prev := nullResp()
+	if get && exists {
+		prev = bulkResp(old.V)
+	}
+	if (nx && exists) || (xx && !exists) {
+		return prev
+	}
 
+	err := db.Set(k, v, state)
 	if err != nil {
-		DB.mu.Unlock()
 		return &Resp{
 			sign: Error,
-			err:  "ERR" + err.Error(),
+			err:  "ERR " + err.Error(),
 		}
 	}
 
-	if state.conf.aofEnabled {
-		log.Println("saving aof file")
-		state.aof.w.Write(r)
-		if state.conf.aofFSync == Always {
-			state.aof.w.Flush()
-		}
-	}
-	if len(state.conf.rdb) >= 0 {
-		IncrRDBTracker()
+	// log the expiry as an absolute timestamp so replay never extends it
+	logged := []string{"SET", k, v}
+	item := db.store[k]
+	db.notify(notifyString, "set", k)
+	switch {
+	case hasExp:
+		db.SetExpiry(k, item, exp)
+		db.notify(notifyGeneric, "expire", k)
+		logged = append(logged, "PXAT", strconv.FormatInt(exp.UnixMilli(), 10))
+	case keepTTL && exists:
+		db.SetExpiry(k, item, old.Exp)
+		logged = append(logged, "KEEPTTL")
 	}
 
-	// if state.conf.rdbEnabled { // <- use a real flag
-	// 	IncrRDBTracker()
-	// }
-	DB.mu.Unlock()
+	rewriteCommand(cmdResp(logged...))
+	IncrRDBTracker()
 
+	if get {
+		return prev
+	}
 	return &Resp{
 		sign: SimpleString,
 		str:  "OK",
@@ -125,6 +498,7 @@ func set(c *Client, r *Resp, state *AppState) *Resp {
 }
 
 func get(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
 	args := r.arr[1:]
 	if len(args) != 1 {
 		return &Resp{
@@ -134,9 +508,9 @@ func get(c *Client, r *Resp, state *AppState) *Resp {
 	}
 
 	// --------- db locked ---------
-	DB.mu.RLock()
-	item, ok := DB.Get(args[0].bulk)
-	DB.mu.RUnlock()
+	db.mu.Lock()
+	item, ok := db.Get(args[0].bulk)
+	db.mu.Unlock()
 	// --------- db unlocked ---------
 
 	if !ok {
@@ -144,6 +518,9 @@ func get(c *Client, r *Resp, state *AppState) *Resp {
 			sign: Null,
 		}
 	}
+	if item.Type != StringType {
+		return wrongTypeErr()
+	}
 	return &Resp{
 		sign: BulkString,
 		bulk: item.V,
@@ -151,18 +528,22 @@ func get(c *Client, r *Resp, state *AppState) *Resp {
 }
 
 func del(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
 	args := r.arr[1:]
 	var n int
 
-	DB.mu.Lock()
-	defer DB.mu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
 	for _, arg := range args {
-		if _, ok := DB.store[arg.bulk]; ok {
-			DB.Delete(arg.bulk)
+		if _, ok := db.Get(arg.bulk); ok {
+			db.Delete(arg.bulk)
 			n++
 		}
 	}
+	if n > 0 {
+		IncrRDBTracker()
+	}
 
 	return &Resp{
 		sign: Integer,
@@ -171,17 +552,18 @@ func del(c *Client, r *Resp, state *AppState) *Resp {
 }
 
 func exists(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
 	args := r.arr[1:]
 	var n int
 
-	DB.mu.Lock()
+	db.mu.Lock()
 	for _, arg := range args {
-		_, ok := DB.store[arg.bulk]
+		_, ok := db.Get(arg.bulk)
 		if ok {
 			n++
 		}
 	}
-	DB.mu.Unlock()
+	db.mu.Unlock()
 	return &Resp{
 		sign: Integer,
 		num:  n,
@@ -189,8 +571,9 @@ func exists(c *Client, r *Resp, state *AppState) *Resp {
 }
 
 func keys(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
 	args := r.arr[1:]
-	if len(args) > 1 {
+	if len(args) != 1 {
 		return &Resp{
 			sign: Error,
 			err:  "ERR invalid args for 'KEYS'",
@@ -198,19 +581,16 @@ func keys(c *Client, r *Resp, state *AppState) *Resp {
 	}
 	pattern := args[0].bulk
 
-	DB.mu.RLock()
+	// only the subtree under the pattern's literal prefix can match
+	db.mu.RLock()
 	var matches []string
-	for key := range DB.store {
-		matched, err := filepath.Match(pattern, key)
-		if err != nil {
-			log.Printf("error matching keys: (pattern: %s, key: %s)- %s", pattern, key, err)
-			continue
-		}
-		if matched {
+	db.keyIdx.walkPrefix(globPrefix(pattern), "", func(key string) bool {
+		if _, ok := db.peek(key); ok && matchKey(pattern, key) {
 			matches = append(matches, key)
 		}
-	}
-	DB.mu.RUnlock()
+		return true
+	})
+	db.mu.RUnlock()
 
 	reply := &Resp{
 		sign: Array,
@@ -222,6 +602,124 @@ func keys(c *Client, r *Resp, state *AppState) *Resp {
 	return reply
 }
 
+// keysprefix implements KEYSPREFIX prefix [AFTER key] [COUNT count]. It
+// lists keys starting with prefix in lexicographic order. Passing the last
+// key of a reply as AFTER resumes the listing, even across writes.
+func keysprefix(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 || len(args)%2 == 0 {
+		return argsErr("KEYSPREFIX")
+	}
+	prefix := args[0].bulk
+
+	var after string
+	count := -1
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i].bulk) {
+		case "AFTER":
+			after = args[i+1].bulk
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil || n < 1 {
+				return notIntErr()
+			}
+			count = n
+		default:
+			return syntaxErr()
+		}
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	matches := []string{}
+	db.keyIdx.walkPrefix(prefix, after, func(key string) bool {
+		if _, ok := db.peek(key); ok {
+			matches = append(matches, key)
+		}
+		return len(matches) != count
+	})
+	return arrResp(matches)
+}
+
+// matchKey reports whether key matches the glob pattern used by KEYS and
+// SCAN MATCH.
+func matchKey(pattern, key string) bool {
+	matched, err := filepath.Match(pattern, key)
+	if err != nil {
+		log.Printf("error matching keys: (pattern: %s, key: %s)- %s", pattern, key, err)
+		return false
+	}
+	return matched
+}
+
+// scanCmd implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+// COUNT bounds the number of keys visited per call; MATCH and TYPE filter
+// the visited keys, so a call may return fewer keys or none at all.
+func scanCmd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("SCAN")
+	}
+	cursor, err := strconv.ParseUint(args[0].bulk, 10, 64)
+	if err != nil {
+		return errResp("ERR invalid cursor")
+	}
+
+	pattern, typ, count := "", "", 10
+	for i := 1; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return syntaxErr()
+		}
+		switch strings.ToUpper(args[i].bulk) {
+		case "MATCH":
+			pattern = args[i+1].bulk
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return notIntErr()
+			}
+			if count < 1 {
+				return syntaxErr()
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1].bulk)
+		default:
+			return syntaxErr()
+		}
+		i++
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	visited, next := db.scan(cursor, count)
+	keys := make([]string, 0, len(visited))
+	for _, k := range visited {
+		item, ok := db.peek(k)
+		if !ok {
+			continue
+		}
+		if typ != "" && item.Type.String() != typ {
+			continue
+		}
+		if pattern != "" && !matchKey(pattern, k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	return &Resp{
+		sign: Array,
+		arr: []Resp{
+			{sign: BulkString, bulk: strconv.FormatUint(next, 10)},
+			*arrResp(keys),
+		},
+	}
+}
+
 func save(c *Client, r *Resp, state *AppState) *Resp {
 	SaveRDB(state)
 	return &Resp{
@@ -230,25 +728,16 @@ func save(c *Client, r *Resp, state *AppState) *Resp {
 }
 
 func bgsave(c *Client, r *Resp, state *AppState) *Resp {
-	if state.bgsaveRunning {
+	if !state.bgsaveRunning.CompareAndSwap(false, true) {
 		return &Resp{
 			sign: Error, err: "ERR background save is already running",
 		}
 	}
 
-	cp := make(map[string]*Item, len(DB.store))
-	DB.mu.RLock()
-	maps.Copy(cp, DB.store)
-	DB.mu.RUnlock()
-
-	state.bgsaveRunning = true
-	state.dbCopy = cp
+	cp := snapshotDBs()
 	go func() {
-		defer func() {
-			state.bgsaveRunning = false
-			state.dbCopy = nil
-		}()
-		SaveRDB(state)
+		defer state.bgsaveRunning.Store(false)
+		saveRDB(state, cp)
 	}()
 
 	return &Resp{
@@ -258,9 +747,10 @@ func bgsave(c *Client, r *Resp, state *AppState) *Resp {
 }
 
 func dbsize(c *Client, r *Resp, state *AppState) *Resp {
-	DB.mu.RLock()
-	defer DB.mu.RUnlock()
-	size := len(DB.store)
+	db := DBs[c.db]
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	size := len(db.store)
 
 	return &Resp{
 		sign: Integer,
@@ -269,9 +759,13 @@ func dbsize(c *Client, r *Resp, state *AppState) *Resp {
 }
 
 func flushdb(c *Client, r *Resp, state *AppState) *Resp {
-	DB.mu.Lock()
-	defer DB.mu.Unlock()
-	DB.store = map[string]*Item{}
+	db := DBs[c.db]
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.store = map[string]*Item{}
+	db.reindex()
+	db.touchAll()
+	IncrRDBTracker()
 
 	return &Resp{
 		sign: SimpleString,
@@ -279,6 +773,20 @@ func flushdb(c *Client, r *Resp, state *AppState) *Resp {
 	}
 }
 
+func flushall(c *Client, r *Resp, state *AppState) *Resp {
+	// hold every database, in index order, so no reader sees some flushed
+	// and others not
+	for _, db := range DBs {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.store = map[string]*Item{}
+		db.reindex()
+		db.touchAll()
+	}
+	IncrRDBTracker()
+	return okResp()
+}
+
 func auth(c *Client, r *Resp, state *AppState) *Resp {
 	args := r.arr[1:]
 	if len(args) != 1 {
@@ -305,92 +813,181 @@ func auth(c *Client, r *Resp, state *AppState) *Resp {
 }
 
 func expire(c *Client, r *Resp, state *AppState) *Resp {
+	return expireGeneric(DBs[c.db], r, state, "EX")
+}
+
+func pexpire(c *Client, r *Resp, state *AppState) *Resp {
+	return expireGeneric(DBs[c.db], r, state, "PX")
+}
+
+func expireat(c *Client, r *Resp, state *AppState) *Resp {
+	return expireGeneric(DBs[c.db], r, state, "EXAT")
+}
+
+func pexpireat(c *Client, r *Resp, state *AppState) *Resp {
+	return expireGeneric(DBs[c.db], r, state, "PXAT")
+}
+
+// expireGeneric implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT with
+// their NX | XX | GT | LT flags. unit says how expiryAt reads the time
+// argument. The new expiry is logged as PEXPIREAT so AOF replay can never
+// extend a key's lifetime.
+func expireGeneric(db *Database, r *Resp, state *AppState, unit string) *Resp {
+	cmd := strings.ToLower(r.arr[0].bulk)
 	args := r.arr[1:]
-	if len(args) != 2 {
-		return &Resp{
-			sign: Error,
-			err:  "ERR invalid args for 'EXPIRE'",
-		}
+	if len(args) < 2 {
+		return argsErr(r.arr[0].bulk)
 	}
 	k := args[0].bulk
-	secs := args[1].bulk
-	// secs := args[1].num
-
-	expSecs, err := strconv.Atoi(secs)
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
 	if err != nil {
-		return &Resp{
-			sign: Error,
-			err:  "ERR invalid value for 'EXPIRE'",
+		return notIntErr()
+	}
+
+	var nx, xx, gt, lt bool
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg.bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return errResp("ERR Unsupported option " + arg.bulk)
 		}
 	}
+	if nx && (xx || gt || lt) {
+		return errResp("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if gt && lt {
+		return errResp("ERR GT and LT options at the same time are not compatible")
+	}
+
+	exp, ok := expiryAt(unit, n)
+	if !ok {
+		return errResp("ERR invalid expire time in '" + cmd + "' command")
+	}
 
-	DB.mu.Lock()
-	defer DB.mu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	key, ok := DB.store[k]
+	item, ok := db.Get(k)
 	if !ok {
-		return &Resp{
-			sign: Integer,
-			num:  0,
-		}
+		return intResp(0)
 	}
-	key.Exp = time.Now().Add(time.Duration(expSecs) * time.Second)
 
-	return &Resp{
-		sign: Integer,
-		num:  1,
+	// a key without a TTL counts as living forever for GT and LT
+	hasExp := item.hasExpiry()
+	switch {
+	case nx && hasExp,
+		xx && !hasExp,
+		gt && (!hasExp || !exp.After(item.Exp)),
+		lt && hasExp && !exp.Before(item.Exp):
+		return intResp(0)
 	}
+
+	if !exp.After(time.Now()) {
+		db.Delete(k)
+		rewriteCommand(cmdResp("DEL", k))
+		IncrRDBTracker()
+		return intResp(1)
+	}
+
+	db.SetExpiry(k, item, exp)
+	db.notify(notifyGeneric, "expire", k)
+	rewriteCommand(cmdResp("PEXPIREAT", k, strconv.FormatInt(exp.UnixMilli(), 10)))
+	IncrRDBTracker()
+	return intResp(1)
 }
 
 func ttl(c *Client, r *Resp, state *AppState) *Resp {
+	return ttlGeneric(DBs[c.db], r, false, false)
+}
+
+func pttl(c *Client, r *Resp, state *AppState) *Resp {
+	return ttlGeneric(DBs[c.db], r, true, false)
+}
+
+func expiretime(c *Client, r *Resp, state *AppState) *Resp {
+	return ttlGeneric(DBs[c.db], r, false, true)
+}
+
+func pexpiretime(c *Client, r *Resp, state *AppState) *Resp {
+	return ttlGeneric(DBs[c.db], r, true, true)
+}
+
+// ttlGeneric implements TTL, PTTL, EXPIRETIME and PEXPIRETIME. It replies
+// -2 for a missing key and -1 for a key without an expiry; otherwise the
+// remaining time, or the absolute Unix time when abs is set.
+func ttlGeneric(db *Database, r *Resp, ms, abs bool) *Resp {
 	args := r.arr[1:]
 	if len(args) != 1 {
-		return &Resp{
-			sign: Error,
-			err:  "ERR invalid args for 'TTL'",
-		}
+		return argsErr(r.arr[0].bulk)
 	}
 
-	k := args[0].bulk
-	DB.mu.Lock()
-	defer DB.mu.Unlock()
-	key, ok := DB.store[k]
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, ok := db.Get(args[0].bulk)
 	if !ok {
-		return &Resp{
-			sign: Integer,
-			num:  -2,
-		}
+		return intResp(-2)
+	}
+	if !item.hasExpiry() {
+		return intResp(-1)
 	}
-	exp := key.Exp
 
-	if exp.Unix() == UNIX_TS_EPOCH {
-		return &Resp{
-			sign: Integer,
-			num:  -1,
+	if abs {
+		if ms {
+			return intResp(int(item.Exp.UnixMilli()))
 		}
+		return intResp(int(item.Exp.Unix()))
 	}
-	expSecs := int(time.Until(exp).Seconds())
-	if expSecs <= 0 {
-		DB.Delete(k)
-		return &Resp{
-			sign: Integer,
-			num:  -2,
-		}
+
+	remaining := time.Until(item.Exp).Milliseconds()
+	if ms {
+		return intResp(int(remaining))
 	}
+	return intResp(int((remaining + 500) / 1000))
+}
 
-	return &Resp{
-		sign: Integer,
-		num:  expSecs,
+func persist(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("PERSIST")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, ok := db.Get(k)
+	if !ok || !item.hasExpiry() {
+		return intResp(0)
 	}
+
+	db.SetExpiry(k, item, time.Time{})
+	db.notify(notifyGeneric, "persist", k)
+	IncrRDBTracker()
+	return intResp(1)
 }
 
 func bgwriteaof(c *Client, r *Resp, state *AppState) *Resp {
+	if !state.conf.aofEnabled {
+		return errResp("ERR AOF is disabled")
+	}
+	// snapshot and switch to a new incremental file at the same point
+	unlock := rlockDBs()
+	cp := copyDBs()
+	err := state.aof.startRewrite()
+	unlock()
+	if err != nil {
+		return errResp("ERR " + err.Error())
+	}
 	go func() {
-		DB.mu.RLock()
-		defer DB.mu.RUnlock()
-		cp := make(map[string]*Item, len(DB.store))
-		maps.Copy(cp, DB.store)
-
 		state.aof.Rewrite(cp)
 	}()
 	return &Resp{
@@ -424,9 +1021,32 @@ func _exec(c *Client, r *Resp, state *AppState) *Resp {
 		}
 	}
 
+	if c.tx.aborted {
+		c.unwatchAll()
+		c.tx = nil
+		return &Resp{
+			sign: Error,
+			err:  "EXECABORT Transaction discarded because of previous errors.",
+		}
+	}
+
+	// a watched key was modified, so the transaction is not run
+	if c.watchesChanged() {
+		c.unwatchAll()
+		c.tx = nil
+		return nullResp()
+	}
+	c.unwatchAll()
+
+	// the writes are logged as one MULTI/EXEC block
+	if state.conf.aofEnabled {
+		state.aof.beginTx()
+		defer state.aof.commitTx(state)
+	}
+
 	replies := make([]Resp, len(c.tx.cmds))
 	for i, cmd := range c.tx.cmds {
-		reply := cmd.handler(c, cmd.r, state)
+		reply := call(cmd.cmd, cmd.handler, c, cmd.r, state)
 		replies[i] = *reply // direct assignment
 	}
 	reply := Resp{
@@ -446,8 +1066,5107 @@ func discard(c *Client, r *Resp, state *AppState) *Resp {
 	}
 
 	c.tx = nil
+	c.unwatchAll()
 	return &Resp{
 		sign: SimpleString,
 		str:  "OK",
 	}
 }
+
+// watchCmd implements WATCH key [key ...] against the selected database.
+func watchCmd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("WATCH")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, arg := range args {
+		db.watch(c, arg.bulk)
+	}
+	return okResp()
+}
+
+func unwatch(c *Client, r *Resp, state *AppState) *Resp {
+	c.unwatchAll()
+	return okResp()
+}
+
+// ---------------------------------------------------------------------------
+// lists
+// ---------------------------------------------------------------------------
+
+// itemForWrite returns the item of type typ stored at k, creating an empty
+// one when create is set and the key is missing. The caller must hold db.mu.
+func itemForWrite(db *Database, k string, typ ItemType, create bool) (*Item, *Resp) {
+	item, ok := db.Get(k)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		item = NewItem(typ)
+		db.Put(k, item)
+		return item, nil
+	}
+	if item.Type != typ {
+		return nil, wrongTypeErr()
+	}
+	return item, nil
+}
+
+// itemForRead returns the item of type typ stored at k, or nil when the
+// key is missing. Like GET it records the access, which LRU/LFU eviction
+// and OBJECT FREQ/IDLETIME go by, so the caller must hold db.mu for
+// writing.
+func itemForRead(db *Database, k string, typ ItemType) (*Item, *Resp) {
+	return itemForWrite(db, k, typ, false)
+}
+
+// listPop pops up to count elements from one end of the list at k. The
+// event is reported inside Update so it precedes the del of an emptied list.
+func listPop(db *Database, k string, item *Item, left bool, count int) []string {
+	var popped []string
+	db.Update(k, item, func() {
+		for len(popped) < count && item.L.Len() > 0 {
+			var v string
+			if left {
+				v, _ = item.L.PopFront()
+			} else {
+				v, _ = item.L.PopBack()
+			}
+			popped = append(popped, v)
+		}
+		if left {
+			db.notify(notifyList, "lpop", k)
+		} else {
+			db.notify(notifyList, "rpop", k)
+		}
+	})
+	return popped
+}
+
+func listPush(db *Database, k string, item *Item, left bool, vals ...string) {
+	db.Update(k, item, func() {
+		for _, v := range vals {
+			if left {
+				item.L.PushFront(v)
+			} else {
+				item.L.PushBack(v)
+			}
+		}
+		if left {
+			db.notify(notifyList, "lpush", k)
+		} else {
+			db.notify(notifyList, "rpush", k)
+		}
+	})
+}
+
+func lpush(c *Client, r *Resp, state *AppState) *Resp {
+	return pushGeneric(DBs[c.db], r, state, true)
+}
+
+func rpush(c *Client, r *Resp, state *AppState) *Resp {
+	return pushGeneric(DBs[c.db], r, state, false)
+}
+
+func pushGeneric(db *Database, r *Resp, state *AppState, left bool) *Resp {
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr(r.arr[0].bulk)
+	}
+	k := args[0].bulk
+	vals := make([]string, 0, len(args)-1)
+	var required int64
+	for _, arg := range args[1:] {
+		vals = append(vals, arg.bulk)
+		required += int64(len(arg.bulk) + 16)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, required); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, ListType, true)
+	if errReply != nil {
+		return errReply
+	}
+
+	listPush(db, k, item, left, vals...)
+	n := item.L.Len()
+	IncrRDBTracker()
+
+	db.serveBlocked(k)
+	return intResp(n)
+}
+
+func lpop(c *Client, r *Resp, state *AppState) *Resp {
+	return popGeneric(DBs[c.db], r, state, true)
+}
+
+func rpop(c *Client, r *Resp, state *AppState) *Resp {
+	return popGeneric(DBs[c.db], r, state, false)
+}
+
+func popGeneric(db *Database, r *Resp, state *AppState, left bool) *Resp {
+	args := r.arr[1:]
+	if len(args) < 1 || len(args) > 2 {
+		return argsErr(r.arr[0].bulk)
+	}
+	k := args[0].bulk
+
+	count := -1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return errResp("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, ListType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return nullResp()
+	}
+
+	if count < 0 {
+		v := listPop(db, k, item, left, 1)[0]
+		IncrRDBTracker()
+		return bulkResp(v)
+	}
+
+	popped := []string{}
+	if count > 0 {
+		popped = listPop(db, k, item, left, count)
+		IncrRDBTracker()
+	}
+	return arrResp(popped)
+}
+
+func llen(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("LLEN")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, ListType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	return intResp(item.L.Len())
+}
+
+func lrange(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("LRANGE")
+	}
+	start, err1 := strconv.Atoi(args[1].bulk)
+	stop, err2 := strconv.Atoi(args[2].bulk)
+	if err1 != nil || err2 != nil {
+		return notIntErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, ListType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return arrResp(nil)
+	}
+	return arrResp(item.L.Range(start, stop))
+}
+
+func lindex(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("LINDEX")
+	}
+	i, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return notIntErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, ListType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return nullResp()
+	}
+	v, ok := item.L.Index(i)
+	if !ok {
+		return nullResp()
+	}
+	return bulkResp(v)
+}
+
+func lset(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("LSET")
+	}
+	k := args[0].bulk
+	i, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return notIntErr()
+	}
+	v := args[2].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, int64(len(v))); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, ListType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return errResp("ERR no such key")
+	}
+
+	var ok bool
+	db.Update(k, item, func() {
+		ok = item.L.Set(i, v)
+	})
+	if !ok {
+		return errResp("ERR index out of range")
+	}
+
+	db.notify(notifyList, "lset", k)
+	IncrRDBTracker()
+	return okResp()
+}
+
+func lrem(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("LREM")
+	}
+	k := args[0].bulk
+	count, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return notIntErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, ListType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+
+	var removed int
+	db.Update(k, item, func() {
+		removed = item.L.Remove(count, args[2].bulk)
+		if removed > 0 {
+			db.notify(notifyList, "lrem", k)
+		}
+	})
+	if removed > 0 {
+		IncrRDBTracker()
+	}
+	return intResp(removed)
+}
+
+func ltrim(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("LTRIM")
+	}
+	k := args[0].bulk
+	start, err1 := strconv.Atoi(args[1].bulk)
+	stop, err2 := strconv.Atoi(args[2].bulk)
+	if err1 != nil || err2 != nil {
+		return notIntErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, ListType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return okResp()
+	}
+
+	db.Update(k, item, func() {
+		item.L.Trim(start, stop)
+		db.notify(notifyList, "ltrim", k)
+	})
+	IncrRDBTracker()
+	return okResp()
+}
+
+func linsert(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 4 {
+		return argsErr("LINSERT")
+	}
+	k := args[0].bulk
+	var before bool
+	switch strings.ToUpper(args[1].bulk) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+		before = false
+	default:
+		return syntaxErr()
+	}
+	pivot, v := args[2].bulk, args[3].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, int64(len(v)+16)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, ListType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+
+	var n int
+	db.Update(k, item, func() {
+		n = item.L.Insert(before, pivot, v)
+	})
+	if n > 0 {
+		db.notify(notifyList, "linsert", k)
+		IncrRDBTracker()
+	}
+	return intResp(n)
+}
+
+// parseListEnd parses the LEFT/RIGHT arguments of LMOVE and BLMOVE.
+func parseListEnd(s string) (left bool, ok bool) {
+	switch strings.ToUpper(s) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// listMove pops an element from one end of src and pushes it onto dst. It
+// returns a nil reply when src is empty. The caller must hold db.mu, and
+// serves clients blocked on dst once the move has been logged.
+func listMove(db *Database, src, dst string, fromLeft, toLeft bool) *Resp {
+	srcItem, errReply := itemForWrite(db, src, ListType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if srcItem == nil {
+		return nullResp()
+	}
+	if dstItem, ok := db.peek(dst); ok && dstItem.Type != ListType {
+		return wrongTypeErr()
+	}
+
+	v := listPop(db, src, srcItem, fromLeft, 1)[0]
+	dstItem, _ := itemForWrite(db, dst, ListType, true)
+	listPush(db, dst, dstItem, toLeft, v)
+	return bulkResp(v)
+}
+
+func lmove(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 4 {
+		return argsErr("LMOVE")
+	}
+	fromLeft, ok1 := parseListEnd(args[2].bulk)
+	toLeft, ok2 := parseListEnd(args[3].bulk)
+	if !ok1 || !ok2 {
+		return syntaxErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	reply := listMove(db, args[0].bulk, args[1].bulk, fromLeft, toLeft)
+	if reply.sign == BulkString {
+		IncrRDBTracker()
+		db.serveBlocked(args[1].bulk)
+	}
+	return reply
+}
+
+func blpop(c *Client, r *Resp, state *AppState) *Resp {
+	return bpopGeneric(DBs[c.db], c, r, state, true)
+}
+
+func brpop(c *Client, r *Resp, state *AppState) *Resp {
+	return bpopGeneric(DBs[c.db], c, r, state, false)
+}
+
+func bpopGeneric(db *Database, c *Client, r *Resp, state *AppState, left bool) *Resp {
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr(r.arr[0].bulk)
+	}
+	timeout, err := parseTimeout(args[len(args)-1].bulk)
+	if err != nil {
+		return errResp(err.Error())
+	}
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[:len(args)-1] {
+		keys = append(keys, arg.bulk)
+	}
+
+	popCmd := "RPOP"
+	if left {
+		popCmd = "LPOP"
+	}
+	// pops are logged as their non-blocking equivalent so AOF replay
+	// never blocks, along with the write that served them if they waited
+	preventPropagation()
+	pop := func(k string, item *Item) *Resp {
+		v := listPop(db, k, item, left, 1)[0]
+		alsoPropagate(db, cmdResp(popCmd, k))
+		IncrRDBTracker()
+		return arrResp([]string{k, v})
+	}
+
+	db.mu.Lock()
+	for _, k := range keys {
+		item, errReply := itemForWrite(db, k, ListType, false)
+		if errReply != nil {
+			db.mu.Unlock()
+			return errReply
+		}
+		if item != nil {
+			reply := pop(k, item)
+			db.mu.Unlock()
+			return reply
+		}
+	}
+
+	// inside MULTI a blocking pop behaves like its non-blocking form
+	if c.tx != nil {
+		db.mu.Unlock()
+		return nullResp()
+	}
+
+	bc := &blockedClient{
+		keys: keys,
+		ch:   make(chan *Resp, 1),
+		serve: func(k string) *Resp {
+			item, ok := db.store[k]
+			if !ok || item.Type != ListType || item.L.Len() == 0 {
+				return nil
+			}
+			return pop(k, item)
+		},
+	}
+	db.block(bc)
+	db.mu.Unlock()
+
+	return db.waitBlocked(c, bc, timeout, state)
+}
+
+func blmove(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 5 {
+		return argsErr("BLMOVE")
+	}
+	src, dst := args[0].bulk, args[1].bulk
+	fromLeft, ok1 := parseListEnd(args[2].bulk)
+	toLeft, ok2 := parseListEnd(args[3].bulk)
+	if !ok1 || !ok2 {
+		return syntaxErr()
+	}
+	timeout, err := parseTimeout(args[4].bulk)
+	if err != nil {
+		return errResp(err.Error())
+	}
+
+	// logged as LMOVE, like the pops of BLPOP
+	preventPropagation()
+	move := func() *Resp {
+		reply := listMove(db, src, dst, fromLeft, toLeft)
+		if reply.sign == BulkString {
+			alsoPropagate(db, cmdResp("LMOVE", src, dst, args[2].bulk, args[3].bulk))
+			IncrRDBTracker()
+			db.serveBlocked(dst)
+		}
+		return reply
+	}
+
+	db.mu.Lock()
+	reply := move()
+	if reply.sign != Null || c.tx != nil {
+		db.mu.Unlock()
+		return reply
+	}
+
+	bc := &blockedClient{
+		keys: []string{src},
+		ch:   make(chan *Resp, 1),
+		serve: func(k string) *Resp {
+			if reply := move(); reply.sign != Null {
+				return reply
+			}
+			return nil
+		},
+	}
+	db.block(bc)
+	db.mu.Unlock()
+
+	return db.waitBlocked(c, bc, timeout, state)
+}
+
+// ---------------------------------------------------------------------------
+// hashes
+// ---------------------------------------------------------------------------
+
+func hset(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 3 || len(args)%2 == 0 {
+		return argsErr(r.arr[0].bulk)
+	}
+	k := args[0].bulk
+	var required int64
+	for _, arg := range args[1:] {
+		required += int64(len(arg.bulk) + 16)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, required); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, HashType, true)
+	if errReply != nil {
+		return errReply
+	}
+
+	var added int
+	db.Update(k, item, func() {
+		for i := 1; i < len(args); i += 2 {
+			if item.H.Set(args[i].bulk, args[i+1].bulk) {
+				added++
+			}
+		}
+	})
+
+	db.notify(notifyHash, "hset", k)
+	IncrRDBTracker()
+	if r.arr[0].bulk == "HMSET" {
+		return okResp()
+	}
+	return intResp(added)
+}
+
+func hsetnx(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("HSETNX")
+	}
+	k, f, v := args[0].bulk, args[1].bulk, args[2].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, int64(len(f)+len(v)+32)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, HashType, true)
+	if errReply != nil {
+		return errReply
+	}
+	if _, ok := item.H.Get(f); ok {
+		return intResp(0)
+	}
+
+	db.Update(k, item, func() {
+		item.H.Set(f, v)
+	})
+	db.notify(notifyHash, "hset", k)
+	IncrRDBTracker()
+	return intResp(1)
+}
+
+func hget(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("HGET")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, HashType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return nullResp()
+	}
+	v, ok := item.H.Get(args[1].bulk)
+	if !ok {
+		return nullResp()
+	}
+	return bulkResp(v)
+}
+
+func hmget(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("HMGET")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, HashType)
+	if errReply != nil {
+		return errReply
+	}
+
+	reply := &Resp{sign: Array}
+	for _, f := range args[1:] {
+		if item == nil {
+			reply.arr = append(reply.arr, *nullResp())
+			continue
+		}
+		v, ok := item.H.Get(f.bulk)
+		if !ok {
+			reply.arr = append(reply.arr, *nullResp())
+			continue
+		}
+		reply.arr = append(reply.arr, *bulkResp(v))
+	}
+	return reply
+}
+
+func hdel(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("HDEL")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, HashType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+
+	var deleted int
+	db.Update(k, item, func() {
+		for _, f := range args[1:] {
+			if item.H.Delete(f.bulk) {
+				deleted++
+			}
+		}
+		if deleted > 0 {
+			db.notify(notifyHash, "hdel", k)
+		}
+	})
+	if deleted > 0 {
+		IncrRDBTracker()
+	}
+	return intResp(deleted)
+}
+
+// hashEntries replies with the fields and/or values of the hash at k.
+func hashEntries(db *Database, r *Resp, fields, vals bool) *Resp {
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr(r.arr[0].bulk)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, HashType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return arrResp(nil)
+	}
+
+	var entries []string
+	for f, v := range item.H.m {
+		if fields {
+			entries = append(entries, f)
+		}
+		if vals {
+			entries = append(entries, v)
+		}
+	}
+	return arrResp(entries)
+}
+
+func hgetall(c *Client, r *Resp, state *AppState) *Resp {
+	return hashEntries(DBs[c.db], r, true, true)
+}
+
+func hkeys(c *Client, r *Resp, state *AppState) *Resp {
+	return hashEntries(DBs[c.db], r, true, false)
+}
+
+func hvals(c *Client, r *Resp, state *AppState) *Resp {
+	return hashEntries(DBs[c.db], r, false, true)
+}
+
+func hlen(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("HLEN")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, HashType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	return intResp(item.H.Len())
+}
+
+func hexists(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("HEXISTS")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, HashType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	if _, ok := item.H.Get(args[1].bulk); ok {
+		return intResp(1)
+	}
+	return intResp(0)
+}
+
+func hincrby(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("HINCRBY")
+	}
+	k, f := args[0].bulk, args[1].bulk
+	incr, err := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err != nil {
+		return notIntErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, int64(len(f)+52)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, HashType, true)
+	if errReply != nil {
+		return errReply
+	}
+
+	var n int64
+	if v, ok := item.H.Get(f); ok {
+		n, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errResp("ERR hash value is not an integer")
+		}
+	}
+	if (incr > 0 && n > math.MaxInt64-incr) || (incr < 0 && n < math.MinInt64-incr) {
+		return errResp("ERR increment or decrement would overflow")
+	}
+	n += incr
+
+	db.Update(k, item, func() {
+		item.H.Set(f, strconv.FormatInt(n, 10))
+	})
+	db.notify(notifyHash, "hincrby", k)
+	IncrRDBTracker()
+	return intResp(int(n))
+}
+
+func hincrbyfloat(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("HINCRBYFLOAT")
+	}
+	k, f := args[0].bulk, args[1].bulk
+	incr, err := strconv.ParseFloat(args[2].bulk, 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		return errResp("ERR value is not a valid float")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, int64(len(f)+64)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, HashType, true)
+	if errReply != nil {
+		return errReply
+	}
+
+	var n float64
+	if v, ok := item.H.Get(f); ok {
+		n, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return errResp("ERR hash value is not a float")
+		}
+	}
+	n += incr
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return errResp("ERR increment would produce NaN or Infinity")
+	}
+	v := formatFloat(n)
+
+	db.Update(k, item, func() {
+		item.H.Set(f, v)
+	})
+	db.notify(notifyHash, "hincrbyfloat", k)
+	// log the result rather than the increment so replay cannot drift
+	rewriteCommand(cmdResp("HSET", k, f, v))
+	IncrRDBTracker()
+	return bulkResp(v)
+}
+
+// ---------------------------------------------------------------------------
+// sets
+// ---------------------------------------------------------------------------
+
+func sadd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("SADD")
+	}
+	k := args[0].bulk
+	var required int64
+	for _, arg := range args[1:] {
+		required += int64(len(arg.bulk) + 64)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, required); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, SetType, true)
+	if errReply != nil {
+		return errReply
+	}
+
+	var added int
+	db.Update(k, item, func() {
+		for _, m := range args[1:] {
+			if item.S.Add(m.bulk) {
+				added++
+			}
+		}
+	})
+	if added > 0 {
+		db.notify(notifySet, "sadd", k)
+		IncrRDBTracker()
+	}
+	return intResp(added)
+}
+
+func srem(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("SREM")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, SetType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+
+	var removed int
+	db.Update(k, item, func() {
+		for _, m := range args[1:] {
+			if item.S.Remove(m.bulk) {
+				removed++
+			}
+		}
+		if removed > 0 {
+			db.notify(notifySet, "srem", k)
+		}
+	})
+	if removed > 0 {
+		IncrRDBTracker()
+	}
+	return intResp(removed)
+}
+
+func smembers(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("SMEMBERS")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, SetType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return arrResp(nil)
+	}
+	return arrResp(item.S.Members())
+}
+
+func sismember(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("SISMEMBER")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, SetType)
+	if errReply != nil {
+		return errReply
+	}
+	if item != nil && item.S.Has(args[1].bulk) {
+		return intResp(1)
+	}
+	return intResp(0)
+}
+
+func smismember(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("SMISMEMBER")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, SetType)
+	if errReply != nil {
+		return errReply
+	}
+
+	reply := &Resp{sign: Array}
+	for _, m := range args[1:] {
+		n := 0
+		if item != nil && item.S.Has(m.bulk) {
+			n = 1
+		}
+		reply.arr = append(reply.arr, *intResp(n))
+	}
+	return reply
+}
+
+func scard(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("SCARD")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, SetType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	return intResp(item.S.Len())
+}
+
+func spop(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 || len(args) > 2 {
+		return argsErr("SPOP")
+	}
+	k := args[0].bulk
+
+	count := -1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return errResp("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, SetType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		if count < 0 {
+			return nullResp()
+		}
+		return arrResp(nil)
+	}
+
+	n := count
+	if n < 0 {
+		n = 1
+	}
+	popped := []string{}
+	db.Update(k, item, func() {
+		for len(popped) < n && item.S.Len() > 0 {
+			m := item.S.Random()
+			item.S.Remove(m)
+			popped = append(popped, m)
+		}
+		if len(popped) > 0 {
+			db.notify(notifySet, "spop", k)
+		}
+	})
+
+	// the members were picked at random, so log exactly which ones went
+	if len(popped) > 0 {
+		rewriteCommand(cmdResp(append([]string{"SREM", k}, popped...)...))
+		IncrRDBTracker()
+	}
+	if count < 0 {
+		return bulkResp(popped[0])
+	}
+	return arrResp(popped)
+}
+
+// srandmemberPrealloc caps the reply SRANDMEMBER allocates up front for a
+// negative count.
+const srandmemberPrealloc = 1024
+
+func srandmember(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 || len(args) > 2 {
+		return argsErr("SRANDMEMBER")
+	}
+
+	count, withCount := 1, len(args) == 2
+	if withCount {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return notIntErr()
+		}
+		// out of range in Redis 7 too; -n always fits
+		if n < -math.MaxInt64/2 || n > math.MaxInt64/2 {
+			return errResp("ERR value is out of range")
+		}
+		count = n
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, SetType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		if withCount {
+			return arrResp(nil)
+		}
+		return nullResp()
+	}
+	if !withCount {
+		return bulkResp(item.S.Random())
+	}
+
+	// a negative count may return the same member several times. The
+	// count comes from the client, so only a bounded part of the reply is
+	// allocated up front.
+	if count < 0 {
+		picked := make([]string, 0, min(-count, srandmemberPrealloc))
+		for range -count {
+			picked = append(picked, item.S.Random())
+		}
+		return arrResp(picked)
+	}
+
+	members := item.S.Members()
+	if count >= len(members) {
+		return arrResp(members)
+	}
+	rand.Shuffle(len(members), func(i, j int) {
+		members[i], members[j] = members[j], members[i]
+	})
+	return arrResp(members[:count])
+}
+
+type setOp int
+
+const (
+	setInter setOp = iota
+	setUnion
+	setDiff
+)
+
+// setStoreEvents names the keyspace event of each *STORE variant.
+var setStoreEvents = [...]string{
+	setInter: "sinterstore",
+	setUnion: "sunionstore",
+	setDiff:  "sdiffstore",
+}
+
+// setAlgebra combines the sets stored at keys. Missing keys count as empty
+// sets. The caller must hold db.mu for writing.
+func setAlgebra(db *Database, keys []string, op setOp) (*HashSet, *Resp) {
+	sets := make([]*HashSet, len(keys))
+	for i, k := range keys {
+		item, errReply := itemForRead(db, k, SetType)
+		if errReply != nil {
+			return nil, errReply
+		}
+		if item == nil {
+			sets[i] = NewHashSet()
+			continue
+		}
+		sets[i] = item.S
+	}
+
+	res := NewHashSet()
+	switch op {
+	case setInter:
+		// walk the smallest set and probe the others
+		smallest := sets[0]
+		for _, s := range sets[1:] {
+			if s.Len() < smallest.Len() {
+				smallest = s
+			}
+		}
+	members:
+		for _, m := range smallest.members {
+			for _, s := range sets {
+				if !s.Has(m) {
+					continue members
+				}
+			}
+			res.Add(m)
+		}
+	case setUnion:
+		for _, s := range sets {
+			for _, m := range s.members {
+				res.Add(m)
+			}
+		}
+	case setDiff:
+		for _, m := range sets[0].members {
+			res.Add(m)
+		}
+		for _, s := range sets[1:] {
+			for _, m := range s.members {
+				res.Remove(m)
+			}
+		}
+	}
+	return res, nil
+}
+
+func setAlgebraGeneric(db *Database, r *Resp, op setOp) *Resp {
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr(r.arr[0].bulk)
+	}
+	keys := make([]string, 0, len(args))
+	for _, arg := range args {
+		keys = append(keys, arg.bulk)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, errReply := setAlgebra(db, keys, op)
+	if errReply != nil {
+		return errReply
+	}
+	return arrResp(res.Members())
+}
+
+// setAlgebraStore stores the result of a set operation at a destination
+// key. Sources are read and the destination written under one lock, so
+// the whole command is atomic.
+func setAlgebraStore(db *Database, r *Resp, state *AppState, op setOp) *Resp {
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr(r.arr[0].bulk)
+	}
+	dst := args[0].bulk
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		keys = append(keys, arg.bulk)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, errReply := setAlgebra(db, keys, op)
+	if errReply != nil {
+		return errReply
+	}
+
+	item := &Item{Type: SetType, S: res}
+	if err := db.ensureMem(state, item.approxMemUsage(dst)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	if res.Len() == 0 {
+		db.Delete(dst)
+	} else {
+		db.Put(dst, item)
+		db.notify(notifySet, setStoreEvents[op], dst)
+	}
+
+	IncrRDBTracker()
+	return intResp(res.Len())
+}
+
+func sinter(c *Client, r *Resp, state *AppState) *Resp {
+	return setAlgebraGeneric(DBs[c.db], r, setInter)
+}
+
+func sunion(c *Client, r *Resp, state *AppState) *Resp {
+	return setAlgebraGeneric(DBs[c.db], r, setUnion)
+}
+
+func sdiff(c *Client, r *Resp, state *AppState) *Resp {
+	return setAlgebraGeneric(DBs[c.db], r, setDiff)
+}
+
+func sinterstore(c *Client, r *Resp, state *AppState) *Resp {
+	return setAlgebraStore(DBs[c.db], r, state, setInter)
+}
+
+func sunionstore(c *Client, r *Resp, state *AppState) *Resp {
+	return setAlgebraStore(DBs[c.db], r, state, setUnion)
+}
+
+func sdiffstore(c *Client, r *Resp, state *AppState) *Resp {
+	return setAlgebraStore(DBs[c.db], r, state, setDiff)
+}
+
+// ---------------------------------------------------------------------------
+// sorted sets
+// ---------------------------------------------------------------------------
+
+func parseScore(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseScoreRange parses ZCOUNT / ZRANGE BYSCORE bounds such as "(1.5",
+// "-inf" and "+inf".
+func parseScoreRange(min, max string) (scoreRange, bool) {
+	var r scoreRange
+	var ok1, ok2 bool
+	if strings.HasPrefix(min, "(") {
+		r.minEx = true
+		min = min[1:]
+	}
+	if strings.HasPrefix(max, "(") {
+		r.maxEx = true
+		max = max[1:]
+	}
+	r.min, ok1 = parseScore(min)
+	r.max, ok2 = parseScore(max)
+	return r, ok1 && ok2
+}
+
+// parseLexRange parses ZRANGE BYLEX bounds: "[a" and "(a" are inclusive
+// and exclusive, "-" and "+" are unbounded.
+func parseLexRange(min, max string) (lexRange, bool) {
+	var r lexRange
+	parse := func(s string, bound *string, ex, inf *bool, infSign string) bool {
+		switch {
+		case s == infSign:
+			*inf = true
+		case strings.HasPrefix(s, "["):
+			*bound = s[1:]
+		case strings.HasPrefix(s, "("):
+			*bound = s[1:]
+			*ex = true
+		default:
+			return false
+		}
+		return true
+	}
+
+	ok1 := parse(min, &r.min, &r.minEx, &r.minInf, "-")
+	ok2 := parse(max, &r.max, &r.maxEx, &r.maxInf, "+")
+	// "+" as a lower bound or "-" as an upper bound selects nothing
+	if min == "+" || max == "-" {
+		return lexRange{min: "1", max: "0"}, true
+	}
+	return r, ok1 && ok2
+}
+
+// zEntriesResp flattens sorted set entries into a reply, interleaving the
+// scores when withScores is set.
+func zEntriesResp(entries []zEntry, withScores bool) *Resp {
+	vals := make([]string, 0, len(entries)*2)
+	for _, e := range entries {
+		vals = append(vals, e.member)
+		if withScores {
+			vals = append(vals, formatFloat(e.score))
+		}
+	}
+	return arrResp(vals)
+}
+
+func zadd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 3 {
+		return argsErr("ZADD")
+	}
+	k := args[0].bulk
+
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return syntaxErr()
+	}
+	if nx && xx {
+		return errResp("ERR XX and NX options at the same time are not compatible")
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return errResp("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) > 2 {
+		return errResp("ERR INCR option supports a single increment-element pair")
+	}
+
+	scores := make([]float64, 0, len(pairs)/2)
+	var required int64
+	for j := 0; j < len(pairs); j += 2 {
+		score, ok := parseScore(pairs[j].bulk)
+		if !ok {
+			return errResp("ERR value is not a valid float")
+		}
+		scores = append(scores, score)
+		required += int64(len(pairs[j+1].bulk) + 128)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, required); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, ZSetType, !xx)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		if incr {
+			return nullResp()
+		}
+		return intResp(0)
+	}
+
+	var added, updated int
+	var incrScore float64
+	incrApplied := false
+	var nanErr bool
+	db.Update(k, item, func() {
+		for j, score := range scores {
+			member := pairs[j*2+1].bulk
+			cur, exists := item.Z.Score(member)
+
+			if !exists {
+				if xx {
+					continue
+				}
+				item.Z.Add(member, score)
+				added++
+				incrScore, incrApplied = score, true
+				continue
+			}
+
+			if nx {
+				continue
+			}
+			if incr {
+				score += cur
+				if math.IsNaN(score) {
+					nanErr = true
+					return
+				}
+			}
+			if (gt && score <= cur) || (lt && score >= cur) {
+				continue
+			}
+			incrScore, incrApplied = score, true
+			if score != cur {
+				item.Z.Add(member, score)
+				updated++
+			}
+		}
+	})
+	if nanErr {
+		return errResp("ERR resulting score is not a number (NaN)")
+	}
+
+	if added+updated > 0 {
+		if incr {
+			db.notify(notifyZSet, "zincr", k)
+		} else {
+			db.notify(notifyZSet, "zadd", k)
+		}
+		IncrRDBTracker()
+	}
+	if incr {
+		if !incrApplied {
+			return nullResp()
+		}
+		return bulkResp(formatFloat(incrScore))
+	}
+	if ch {
+		return intResp(added + updated)
+	}
+	return intResp(added)
+}
+
+func zincrby(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("ZINCRBY")
+	}
+	k, member := args[0].bulk, args[2].bulk
+	incr, ok := parseScore(args[1].bulk)
+	if !ok {
+		return errResp("ERR value is not a valid float")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, int64(len(member)+128)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, ZSetType, false)
+	if errReply != nil {
+		return errReply
+	}
+
+	var cur float64
+	if item != nil {
+		cur, _ = item.Z.Score(member)
+	}
+	score := cur + incr
+	if math.IsNaN(score) {
+		return errResp("ERR resulting score is not a number (NaN)")
+	}
+
+	if item == nil {
+		item, _ = itemForWrite(db, k, ZSetType, true)
+	}
+	db.Update(k, item, func() {
+		item.Z.Add(member, score)
+	})
+	db.notify(notifyZSet, "zincr", k)
+	IncrRDBTracker()
+	return bulkResp(formatFloat(score))
+}
+
+func zscore(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("ZSCORE")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, ZSetType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return nullResp()
+	}
+	score, ok := item.Z.Score(args[1].bulk)
+	if !ok {
+		return nullResp()
+	}
+	return bulkResp(formatFloat(score))
+}
+
+func zcard(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("ZCARD")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, ZSetType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	return intResp(item.Z.Len())
+}
+
+func zrank(c *Client, r *Resp, state *AppState) *Resp {
+	return zrankGeneric(DBs[c.db], r, false)
+}
+
+func zrevrank(c *Client, r *Resp, state *AppState) *Resp {
+	return zrankGeneric(DBs[c.db], r, true)
+}
+
+func zrankGeneric(db *Database, r *Resp, rev bool) *Resp {
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr(r.arr[0].bulk)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, ZSetType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return nullResp()
+	}
+	rank, ok := item.Z.Rank(args[1].bulk, rev)
+	if !ok {
+		return nullResp()
+	}
+	return intResp(rank)
+}
+
+func zrem(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("ZREM")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, ZSetType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+
+	var removed int
+	db.Update(k, item, func() {
+		for _, m := range args[1:] {
+			if item.Z.Remove(m.bulk) {
+				removed++
+			}
+		}
+		if removed > 0 {
+			db.notify(notifyZSet, "zrem", k)
+		}
+	})
+	if removed > 0 {
+		IncrRDBTracker()
+	}
+	return intResp(removed)
+}
+
+func zcount(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("ZCOUNT")
+	}
+	rng, ok := parseScoreRange(args[1].bulk, args[2].bulk)
+	if !ok {
+		return errResp("ERR min or max is not a float")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, ZSetType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	return intResp(item.Z.Count(rng))
+}
+
+// zrange implements ZRANGE key start stop [BYSCORE | BYLEX] [REV]
+// [LIMIT offset count] [WITHSCORES].
+func zrange(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 3 {
+		return argsErr("ZRANGE")
+	}
+	k, start, stop := args[0].bulk, args[1].bulk, args[2].bulk
+
+	var byScore, byLex, rev, withScores, hasLimit bool
+	offset, limit := 0, -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "BYSCORE":
+			byScore = true
+		case "BYLEX":
+			byLex = true
+		case "REV":
+			rev = true
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return syntaxErr()
+			}
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1].bulk)
+			limit, err2 = strconv.Atoi(args[i+2].bulk)
+			if err1 != nil || err2 != nil {
+				return notIntErr()
+			}
+			hasLimit = true
+			i += 2
+		default:
+			return syntaxErr()
+		}
+	}
+	if byScore && byLex {
+		return syntaxErr()
+	}
+	if hasLimit && !byScore && !byLex {
+		return errResp("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if withScores && byLex {
+		return errResp("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	if offset < 0 {
+		return arrResp(nil)
+	}
+
+	// with REV the bounds are given from high to low
+	lo, hi := start, stop
+	if rev && (byScore || byLex) {
+		lo, hi = stop, start
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, k, ZSetType)
+	if errReply != nil {
+		return errReply
+	}
+
+	switch {
+	case byScore:
+		rng, ok := parseScoreRange(lo, hi)
+		if !ok {
+			return errResp("ERR min or max is not a float")
+		}
+		if item == nil {
+			return arrResp(nil)
+		}
+		return zEntriesResp(item.Z.RangeByScore(rng, rev, offset, limit), withScores)
+	case byLex:
+		rng, ok := parseLexRange(lo, hi)
+		if !ok {
+			return errResp("ERR min or max not valid string range item")
+		}
+		if item == nil {
+			return arrResp(nil)
+		}
+		return zEntriesResp(item.Z.RangeByLex(rng, rev, offset, limit), false)
+	default:
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil {
+			return notIntErr()
+		}
+		if item == nil {
+			return arrResp(nil)
+		}
+		return zEntriesResp(item.Z.RangeByRank(from, to, rev), withScores)
+	}
+}
+
+func zpopmin(c *Client, r *Resp, state *AppState) *Resp {
+	return zpopGeneric(DBs[c.db], r, state, false)
+}
+
+func zpopmax(c *Client, r *Resp, state *AppState) *Resp {
+	return zpopGeneric(DBs[c.db], r, state, true)
+}
+
+func zpopGeneric(db *Database, r *Resp, state *AppState, max bool) *Resp {
+	args := r.arr[1:]
+	if len(args) < 1 || len(args) > 2 {
+		return argsErr(r.arr[0].bulk)
+	}
+	k := args[0].bulk
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return errResp("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, ZSetType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return arrResp(nil)
+	}
+
+	var popped []zEntry
+	db.Update(k, item, func() {
+		popped = item.Z.Pop(count, max)
+		switch {
+		case len(popped) == 0:
+		case max:
+			db.notify(notifyZSet, "zpopmax", k)
+		default:
+			db.notify(notifyZSet, "zpopmin", k)
+		}
+	})
+	if len(popped) > 0 {
+		IncrRDBTracker()
+	}
+	return zEntriesResp(popped, true)
+}
+
+// zsetStore implements ZUNIONSTORE and ZINTERSTORE:
+//
+//	dst numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX]
+//
+// Plain sets are accepted as sources, with every member scoring 1.
+func zsetStore(db *Database, r *Resp, state *AppState, union bool) *Resp {
+	args := r.arr[1:]
+	if len(args) < 3 {
+		return argsErr(r.arr[0].bulk)
+	}
+	dst := args[0].bulk
+	numKeys, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return notIntErr()
+	}
+	if numKeys < 1 {
+		return errResp("ERR at least 1 input key is needed for '" + r.arr[0].bulk + "' command")
+	}
+	if len(args) < 2+numKeys {
+		return syntaxErr()
+	}
+	keys := make([]string, 0, numKeys)
+	for _, arg := range args[2 : 2+numKeys] {
+		keys = append(keys, arg.bulk)
+	}
+
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "SUM"
+	for i := 2 + numKeys; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "WEIGHTS":
+			if i+numKeys >= len(args) {
+				return syntaxErr()
+			}
+			for j := range weights {
+				w, ok := parseScore(args[i+1+j].bulk)
+				if !ok {
+					return errResp("ERR weight value is not a float")
+				}
+				weights[j] = w
+			}
+			i += numKeys
+		case "AGGREGATE":
+			if i+1 >= len(args) {
+				return syntaxErr()
+			}
+			aggregate = strings.ToUpper(args[i+1].bulk)
+			if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+				return syntaxErr()
+			}
+			i++
+		default:
+			return syntaxErr()
+		}
+	}
+
+	combine := func(a, b float64) float64 {
+		switch aggregate {
+		case "MIN":
+			return math.Min(a, b)
+		case "MAX":
+			return math.Max(a, b)
+		}
+		// +inf + -inf is treated as 0, as Redis does
+		if sum := a + b; !math.IsNaN(sum) {
+			return sum
+		}
+		return 0
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	sources := make([]map[string]float64, numKeys)
+	for i, k := range keys {
+		src := map[string]float64{}
+		item, ok := db.Get(k)
+		switch {
+		case !ok:
+		case item.Type == ZSetType:
+			for m, score := range item.Z.dict {
+				src[m] = score
+			}
+		case item.Type == SetType:
+			for _, m := range item.S.members {
+				src[m] = 1
+			}
+		default:
+			return wrongTypeErr()
+		}
+		for m, score := range src {
+			weighted := score * weights[i]
+			if math.IsNaN(weighted) {
+				weighted = 0
+			}
+			src[m] = weighted
+		}
+		sources[i] = src
+	}
+
+	res := map[string]float64{}
+	if union {
+		for _, src := range sources {
+			for m, score := range src {
+				if cur, ok := res[m]; ok {
+					res[m] = combine(cur, score)
+				} else {
+					res[m] = score
+				}
+			}
+		}
+	} else {
+	members:
+		for m, score := range sources[0] {
+			for _, src := range sources[1:] {
+				other, ok := src[m]
+				if !ok {
+					continue members
+				}
+				score = combine(score, other)
+			}
+			res[m] = score
+		}
+	}
+
+	item := NewItem(ZSetType)
+	for m, score := range res {
+		item.Z.Add(m, score)
+	}
+	if err := db.ensureMem(state, item.approxMemUsage(dst)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	if item.empty() {
+		db.Delete(dst)
+	} else {
+		db.Put(dst, item)
+		if union {
+			db.notify(notifyZSet, "zunionstore", dst)
+		} else {
+			db.notify(notifyZSet, "zinterstore", dst)
+		}
+	}
+
+	IncrRDBTracker()
+	return intResp(item.Z.Len())
+}
+
+func zunionstore(c *Client, r *Resp, state *AppState) *Resp {
+	return zsetStore(DBs[c.db], r, state, true)
+}
+
+func zinterstore(c *Client, r *Resp, state *AppState) *Resp {
+	return zsetStore(DBs[c.db], r, state, false)
+}
+
+// ---------------------------------------------------------------------------
+// strings
+// ---------------------------------------------------------------------------
+
+// stringForWrite returns the string item at k, or nil when the key is
+// missing. The caller must hold db.mu.
+func stringForWrite(db *Database, k string) (*Item, *Resp) {
+	item, ok := db.Get(k)
+	if !ok {
+		return nil, nil
+	}
+	if item.Type != StringType {
+		return nil, wrongTypeErr()
+	}
+	return item, nil
+}
+
+// setKeepTTL overwrites the string at k but keeps its expiry, as in-place
+// edits such as APPEND and SETRANGE do, and reports the edit as event.
+// The caller must hold db.mu.
+func setKeepTTL(db *Database, k, v, event string, state *AppState) error {
+	var exp time.Time
+	if old, ok := db.store[k]; ok {
+		exp = old.Exp
+	}
+	if err := db.Set(k, v, state); err != nil {
+		return err
+	}
+	db.SetExpiry(k, db.store[k], exp)
+	db.notify(notifyString, event, k)
+	return nil
+}
+
+func mget(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("MGET")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	reply := &Resp{sign: Array}
+	for _, arg := range args {
+		item, ok := db.Get(arg.bulk)
+		if !ok || item.Type != StringType {
+			reply.arr = append(reply.arr, *nullResp())
+			continue
+		}
+		reply.arr = append(reply.arr, *bulkResp(item.V))
+	}
+	return reply
+}
+
+func mset(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 || len(args)%2 != 0 {
+		return argsErr("MSET")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if errReply := msetPairs(db, args, state); errReply != nil {
+		return errReply
+	}
+	return okResp()
+}
+
+// msetPairs sets the key/value pairs of MSET and MSETNX. Room for all of
+// them is made before the first key is written, so running out of memory
+// normally leaves every key untouched. Should a key fail anyway, the
+// command is logged as an MSET of the pairs already set, so the AOF still
+// matches memory. The caller must hold db.mu.
+func msetPairs(db *Database, args []Resp, state *AppState) *Resp {
+	var need int64
+	seen := map[string]bool{}
+	for i := len(args) - 2; i >= 0; i -= 2 {
+		k := args[i].bulk
+		if seen[k] {
+			continue // overwritten by a later pair
+		}
+		seen[k] = true
+		need += (&Item{V: args[i+1].bulk}).approxMemUsage(k)
+		if old, ok := db.store[k]; ok {
+			need -= old.approxMemUsage(k)
+		}
+	}
+	if err := db.ensureMem(state, need); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if err := db.Set(args[i].bulk, args[i+1].bulk, state); err != nil {
+			if i > 0 {
+				rewriteCommand(cmdResp(append([]string{"MSET"}, bulkArgs(args[:i])...)...))
+			}
+			return errResp("ERR " + err.Error())
+		}
+		db.notify(notifyString, "set", args[i].bulk)
+		IncrRDBTracker()
+	}
+	return nil
+}
+
+func msetnx(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 || len(args)%2 != 0 {
+		return argsErr("MSETNX")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := 0; i < len(args); i += 2 {
+		if _, ok := db.Get(args[i].bulk); ok {
+			return intResp(0)
+		}
+	}
+	if errReply := msetPairs(db, args, state); errReply != nil {
+		return errReply
+	}
+	return intResp(1)
+}
+
+func setnx(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("SETNX")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.Get(k); ok {
+		return intResp(0)
+	}
+	if err := db.Set(k, args[1].bulk, state); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	db.notify(notifyString, "set", k)
+	IncrRDBTracker()
+	return intResp(1)
+}
+
+// setex implements SETEX and PSETEX, which take the expiry before the
+// value in seconds or milliseconds respectively.
+func setex(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr(r.arr[0].bulk)
+	}
+	k, v := args[0].bulk, args[2].bulk
+
+	unit := "EX"
+	if strings.ToUpper(r.arr[0].bulk) == "PSETEX" {
+		unit = "PX"
+	}
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return notIntErr()
+	}
+	exp, ok := expiryAt(unit, n)
+	if n <= 0 || !ok {
+		return errResp("ERR invalid expire time in '" + strings.ToLower(r.arr[0].bulk) + "' command")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.Set(k, v, state); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	db.SetExpiry(k, db.store[k], exp)
+	db.notify(notifyString, "set", k)
+	db.notify(notifyGeneric, "expire", k)
+
+	rewriteCommand(cmdResp("SET", k, v, "PXAT", strconv.FormatInt(exp.UnixMilli(), 10)))
+	IncrRDBTracker()
+	return okResp()
+}
+
+func getset(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("GETSET")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, errReply := stringForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+	prev := nullResp()
+	if old != nil {
+		prev = bulkResp(old.V)
+	}
+
+	if err := db.Set(k, args[1].bulk, state); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	db.notify(notifyString, "set", k)
+	IncrRDBTracker()
+	return prev
+}
+
+func getdel(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("GETDEL")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := stringForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return nullResp()
+	}
+
+	db.Delete(k)
+	IncrRDBTracker()
+	return bulkResp(item.V)
+}
+
+// getex implements GETEX key [EX s | PX ms | EXAT ts | PXAT ms-ts | PERSIST].
+func getex(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("GETEX")
+	}
+	k := args[0].bulk
+
+	var persist, hasExp bool
+	var exp time.Time
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch opt {
+		case "PERSIST":
+			if hasExp || persist {
+				return syntaxErr()
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExp || persist || i+1 >= len(args) {
+				return syntaxErr()
+			}
+			n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return notIntErr()
+			}
+			t, ok := expiryAt(opt, n)
+			if n <= 0 || !ok {
+				return errResp("ERR invalid expire time in 'getex' command")
+			}
+			exp, hasExp = t, true
+			i++
+		default:
+			return syntaxErr()
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := stringForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return nullResp()
+	}
+
+	// logged as a plain SET so replay restores the same absolute expiry
+	switch {
+	case hasExp:
+		db.SetExpiry(k, item, exp)
+		db.notify(notifyGeneric, "expire", k)
+		rewriteCommand(cmdResp("SET", k, item.V, "PXAT", strconv.FormatInt(exp.UnixMilli(), 10)))
+		IncrRDBTracker()
+	case persist && item.Exp.Unix() != UNIX_TS_EPOCH:
+		db.SetExpiry(k, item, time.Time{})
+		db.notify(notifyGeneric, "persist", k)
+		rewriteCommand(cmdResp("SET", k, item.V))
+		IncrRDBTracker()
+	}
+	return bulkResp(item.V)
+}
+
+func appendCmd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("APPEND")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := stringForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+	v := args[1].bulk
+	if item != nil {
+		v = item.V + v
+	}
+
+	if err := setKeepTTL(db, k, v, "append", state); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	IncrRDBTracker()
+	return intResp(len(v))
+}
+
+func strlen(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("STRLEN")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := stringForWrite(db, args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	return intResp(len(item.V))
+}
+
+func getrange(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("GETRANGE")
+	}
+	start, err1 := strconv.Atoi(args[1].bulk)
+	end, err2 := strconv.Atoi(args[2].bulk)
+	if err1 != nil || err2 != nil {
+		return notIntErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := stringForWrite(db, args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return bulkResp("")
+	}
+
+	start, end, ok := clampRange(start, end, len(item.V))
+	if !ok {
+		return bulkResp("")
+	}
+	return bulkResp(item.V[start : end+1])
+}
+
+// maxStringSize is the largest string SETRANGE may produce, as in Redis.
+const maxStringSize = 512 * 1024 * 1024
+
+func setrange(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("SETRANGE")
+	}
+	k, patch := args[0].bulk, args[2].bulk
+	offset, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return notIntErr()
+	}
+	if offset < 0 || offset+len(patch) > maxStringSize {
+		return errResp("ERR offset is out of range")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := stringForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+	var v string
+	if item != nil {
+		v = item.V
+	}
+	if len(patch) == 0 {
+		return intResp(len(v))
+	}
+
+	// pad with zero bytes when writing past the end
+	buf := []byte(v)
+	if end := offset + len(patch); end > len(buf) {
+		buf = append(buf, make([]byte, end-len(buf))...)
+	}
+	copy(buf[offset:], patch)
+
+	if err := setKeepTTL(db, k, string(buf), "setrange", state); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	IncrRDBTracker()
+	return intResp(len(buf))
+}
+
+// ---------------------------------------------------------------------------
+// counters
+// ---------------------------------------------------------------------------
+
+// incrGeneric adds incr to the integer stored at k, keeping its TTL.
+func incrGeneric(db *Database, r *Resp, state *AppState, k string, incr int64) *Resp {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := stringForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+
+	var n int64
+	if item != nil {
+		var err error
+		n, err = strconv.ParseInt(item.V, 10, 64)
+		if err != nil {
+			return notIntErr()
+		}
+	}
+	if (incr > 0 && n > math.MaxInt64-incr) || (incr < 0 && n < math.MinInt64-incr) {
+		return errResp("ERR increment or decrement would overflow")
+	}
+	n += incr
+
+	if err := setKeepTTL(db, k, strconv.FormatInt(n, 10), "incrby", state); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	IncrRDBTracker()
+	return intResp(int(n))
+}
+
+func incr(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("INCR")
+	}
+	return incrGeneric(DBs[c.db], r, state, args[0].bulk, 1)
+}
+
+func decr(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("DECR")
+	}
+	return incrGeneric(DBs[c.db], r, state, args[0].bulk, -1)
+}
+
+func incrby(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("INCRBY")
+	}
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return notIntErr()
+	}
+	return incrGeneric(DBs[c.db], r, state, args[0].bulk, n)
+}
+
+func decrby(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("DECRBY")
+	}
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return notIntErr()
+	}
+	if n == math.MinInt64 {
+		return errResp("ERR decrement would overflow")
+	}
+	return incrGeneric(DBs[c.db], r, state, args[0].bulk, -n)
+}
+
+func incrbyfloat(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("INCRBYFLOAT")
+	}
+	k := args[0].bulk
+	incr, err := strconv.ParseFloat(args[1].bulk, 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		return errResp("ERR value is not a valid float")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := stringForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+
+	var n float64
+	if item != nil {
+		n, err = strconv.ParseFloat(item.V, 64)
+		if err != nil || math.IsNaN(n) {
+			return errResp("ERR value is not a valid float")
+		}
+	}
+	n += incr
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return errResp("ERR increment would produce NaN or Infinity")
+	}
+	v := formatFloat(n)
+
+	if err := setKeepTTL(db, k, v, "incrbyfloat", state); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	// log the result rather than the increment so replay cannot drift
+	rewriteCommand(cmdResp("SET", k, v, "KEEPTTL"))
+	IncrRDBTracker()
+	return bulkResp(v)
+}
+
+// ---------------------------------------------------------------------------
+// server
+// ---------------------------------------------------------------------------
+
+// info implements INFO [section]. The stats and keyspace sections are
+// supported; with no argument every section is returned.
+func info(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	section := "all"
+	if len(args) > 0 {
+		section = strings.ToLower(args[0].bulk)
+	}
+
+	var b strings.Builder
+	if section == "all" || section == "default" || section == "stats" {
+		fmt.Fprintf(&b, "# Stats\r\n")
+		fmt.Fprintf(&b, "expired_keys:%d\r\n", ServerStats.expiredKeys.Load())
+		fmt.Fprintf(&b, "expired_stale_perc:%d\r\n", ServerStats.expiredStalePerc.Load())
+		fmt.Fprintf(&b, "expired_time_cap_reached_count:%d\r\n", ServerStats.expiredTimeCapReached.Load())
+		fmt.Fprintf(&b, "expire_cycle_count:%d\r\n", ServerStats.expireCycleCount.Load())
+		fmt.Fprintf(&b, "expire_cycle_cpu_milliseconds:%d\r\n", ServerStats.expireCycleTime.Load()/1000)
+		fmt.Fprintf(&b, "evicted_keys:%d\r\n", ServerStats.evictedKeys.Load())
+		fmt.Fprintf(&b, "\r\n")
+	}
+	if section == "all" || section == "default" || section == "keyspace" {
+		fmt.Fprintf(&b, "# Keyspace\r\n")
+		for _, db := range DBs {
+			db.mu.RLock()
+			keys, expires := len(db.store), db.expires.Len()
+			db.mu.RUnlock()
+
+			if keys > 0 {
+				fmt.Fprintf(&b, "db%d:keys=%d,expires=%d\r\n", db.id, keys, expires)
+			}
+		}
+	}
+	return bulkResp(b.String())
+}
+
+// ---------------------------------------------------------------------------
+// keyspace
+// ---------------------------------------------------------------------------
+
+func typeCmd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("TYPE")
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	item, ok := db.peek(args[0].bulk)
+	if !ok {
+		return &Resp{sign: SimpleString, str: "none"}
+	}
+	return &Resp{sign: SimpleString, str: item.Type.String()}
+}
+
+func rename(c *Client, r *Resp, state *AppState) *Resp {
+	return renameGeneric(DBs[c.db], r, state, false)
+}
+
+func renamenx(c *Client, r *Resp, state *AppState) *Resp {
+	return renameGeneric(DBs[c.db], r, state, true)
+}
+
+// renameGeneric moves the value and TTL of src to dst under a single lock,
+// replacing dst unless nx is set.
+func renameGeneric(db *Database, r *Resp, state *AppState, nx bool) *Resp {
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr(r.arr[0].bulk)
+	}
+	src, dst := args[0].bulk, args[1].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, ok := db.Get(src)
+	if !ok {
+		return errResp("ERR no such key")
+	}
+	if nx {
+		if _, exists := db.Get(dst); exists {
+			return intResp(0)
+		}
+	}
+
+	if src != dst {
+		db.remove(src)
+		db.notify(notifyGeneric, "rename_from", src)
+		db.Put(dst, item)
+		db.notify(notifyGeneric, "rename_to", dst)
+		IncrRDBTracker()
+		db.serveBlocked(dst)
+	}
+
+	if nx {
+		return intResp(1)
+	}
+	return okResp()
+}
+
+// copyCmd implements COPY source destination [DB destination-db]
+// [REPLACE].
+func copyCmd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("COPY")
+	}
+	src, dst := args[0].bulk, args[1].bulk
+
+	dstDB := db
+	var replace bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return syntaxErr()
+			}
+			id, errReply := parseDBIndex(args[i+1].bulk)
+			if errReply != nil {
+				return errReply
+			}
+			dstDB = DBs[id]
+			i++
+		default:
+			return syntaxErr()
+		}
+	}
+	if src == dst && dstDB == db {
+		return errResp("ERR source and destination objects are the same")
+	}
+
+	unlock := lockDBs(db, dstDB)
+	defer unlock()
+
+	item, ok := db.Get(src)
+	if !ok {
+		return intResp(0)
+	}
+	if _, exists := dstDB.Get(dst); exists && !replace {
+		return intResp(0)
+	}
+
+	cp := item.clone()
+	if err := dstDB.ensureMem(state, cp.approxMemUsage(dst)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	dstDB.Put(dst, cp)
+	dstDB.notify(notifyGeneric, "copy_to", dst)
+	IncrRDBTracker()
+	dstDB.serveBlocked(dst)
+	return intResp(1)
+}
+
+func randomkey(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// pick a random rank in the scan index, skipping keys that have
+	// expired but not been reclaimed yet
+	for range 100 {
+		n := db.scanIdx.length
+		if n == 0 {
+			break
+		}
+		k := db.scanIdx.byRank(rand.Intn(n) + 1).member
+		if _, ok := db.peek(k); ok {
+			return bulkResp(k)
+		}
+	}
+	return nullResp()
+}
+
+func touch(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("TOUCH")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var n int
+	for _, arg := range args {
+		if _, ok := db.Get(arg.bulk); ok {
+			n++
+		}
+	}
+	return intResp(n)
+}
+
+// object implements OBJECT ENCODING | FREQ | IDLETIME | REFCOUNT key.
+// Inspecting a key does not count as an access.
+func object(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("OBJECT")
+	}
+	sub := strings.ToUpper(args[0].bulk)
+	if sub == "HELP" {
+		return arrResp([]string{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used to store the value at <key>.",
+			"FREQ <key>",
+			"    Return the number of times the value at <key> has been accessed.",
+			"IDLETIME <key>",
+			"    Return the idle time of the value at <key>, in seconds.",
+			"REFCOUNT <key>",
+			"    Return the reference count of the value at <key>.",
+		})
+	}
+	if len(args) != 2 {
+		return argsErr("OBJECT")
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	item, ok := db.peek(args[1].bulk)
+	if !ok {
+		return nullResp()
+	}
+
+	switch sub {
+	case "ENCODING":
+		return bulkResp(item.encoding())
+	case "FREQ":
+		return intResp(item.AccessCount)
+	case "IDLETIME":
+		return intResp(int(time.Since(item.LastAccess).Seconds()))
+	case "REFCOUNT":
+		return intResp(1)
+	default:
+		return errResp("ERR unknown subcommand '" + args[0].bulk + "'. Try OBJECT HELP.")
+	}
+}
+
+// parseDBIndex parses a database number given to SELECT, MOVE, SWAPDB or
+// COPY.
+func parseDBIndex(s string) (int, *Resp) {
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, notIntErr()
+	}
+	if id < 0 || id >= len(DBs) {
+		return 0, errResp("ERR DB index is out of range")
+	}
+	return id, nil
+}
+
+func selectCmd(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("SELECT")
+	}
+	id, errReply := parseDBIndex(args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	c.db = id
+	return okResp()
+}
+
+// move implements MOVE key db. The key keeps its TTL and is only moved
+// when it does not exist yet in the target database.
+func move(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("MOVE")
+	}
+	k := args[0].bulk
+	id, errReply := parseDBIndex(args[1].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	if id == c.db {
+		return errResp("ERR source and destination objects are the same")
+	}
+	src, dst := DBs[c.db], DBs[id]
+
+	unlock := lockDBs(src, dst)
+	defer unlock()
+
+	item, ok := src.Get(k)
+	if !ok {
+		return intResp(0)
+	}
+	if _, exists := dst.Get(k); exists {
+		return intResp(0)
+	}
+	if err := dst.ensureMem(state, item.approxMemUsage(k)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+
+	src.remove(k)
+	src.notify(notifyGeneric, "move_from", k)
+	dst.Put(k, item)
+	dst.notify(notifyGeneric, "move_to", k)
+
+	IncrRDBTracker()
+	dst.serveBlocked(k)
+	return intResp(1)
+}
+
+// swapdb implements SWAPDB index1 index2. Clients stay on the index they
+// selected and see the other database's data from then on; clients blocked
+// on a key that now holds a list are served.
+func swapdb(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("SWAPDB")
+	}
+	a, errReply := parseDBIndex(args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	b, errReply := parseDBIndex(args[1].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	if a == b {
+		return okResp()
+	}
+	x, y := DBs[a], DBs[b]
+
+	unlock := lockDBs(x, y)
+	defer unlock()
+
+	x.store, y.store = y.store, x.store
+	x.expires, y.expires = y.expires, x.expires
+	x.scanIdx, y.scanIdx = y.scanIdx, x.scanIdx
+	x.keyIdx, y.keyIdx = y.keyIdx, x.keyIdx
+	x.mem, y.mem = y.mem, x.mem
+	x.touchAll()
+	y.touchAll()
+
+	IncrRDBTracker()
+	for _, db := range []*Database{x, y} {
+		for k := range db.blocked {
+			db.serveBlocked(k)
+		}
+	}
+	return okResp()
+}
+
+// ---------------------------------------------------------------------------
+// pub/sub
+// ---------------------------------------------------------------------------
+
+func ping(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) > 1 {
+		return argsErr("PING")
+	}
+	// subscribers get an array, as a plain reply could be mistaken for a
+	// message
+	if c.subscriptions() > 0 {
+		msg := ""
+		if len(args) == 1 {
+			msg = args[0].bulk
+		}
+		return arrResp([]string{"pong", msg})
+	}
+	if len(args) == 1 {
+		return bulkResp(args[0].bulk)
+	}
+	return &Resp{sign: SimpleString, str: "PONG"}
+}
+
+func bulkArgs(args []Resp) []string {
+	vals := make([]string, len(args))
+	for i, arg := range args {
+		vals[i] = arg.bulk
+	}
+	return vals
+}
+
+func subscribe(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("SUBSCRIBE")
+	}
+	PubSub.subscribe(c, bulkArgs(args), false)
+	return nil
+}
+
+func unsubscribe(c *Client, r *Resp, state *AppState) *Resp {
+	PubSub.unsubscribe(c, bulkArgs(r.arr[1:]), false)
+	return nil
+}
+
+func psubscribe(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("PSUBSCRIBE")
+	}
+	PubSub.subscribe(c, bulkArgs(args), true)
+	return nil
+}
+
+func punsubscribe(c *Client, r *Resp, state *AppState) *Resp {
+	PubSub.unsubscribe(c, bulkArgs(r.arr[1:]), true)
+	return nil
+}
+
+func publish(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("PUBLISH")
+	}
+	return intResp(PubSub.publish(args[0].bulk, args[1].bulk))
+}
+
+// pubsub implements PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] |
+// NUMPAT.
+func pubsub(c *Client, r *Resp, state *AppState) *Resp {
+	args := r.arr[1:]
+	if len(args) < 1 {
+		return argsErr("PUBSUB")
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "CHANNELS":
+		if len(args) > 2 {
+			return argsErr("PUBSUB")
+		}
+		pattern := ""
+		if len(args) == 2 {
+			pattern = args[1].bulk
+		}
+		return arrResp(PubSub.activeChannels(pattern))
+	case "NUMSUB":
+		reply := &Resp{sign: Array}
+		for _, arg := range args[1:] {
+			reply.arr = append(reply.arr,
+				Resp{sign: BulkString, bulk: arg.bulk},
+				Resp{sign: Integer, num: PubSub.numSub(arg.bulk)})
+		}
+		return reply
+	case "NUMPAT":
+		if len(args) != 1 {
+			return argsErr("PUBSUB")
+		}
+		return intResp(PubSub.numPat())
+	default:
+		return errResp("ERR unknown subcommand '" + args[0].bulk + "'. Try PUBSUB HELP.")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// t-digests
+// ---------------------------------------------------------------------------
+
+func tdigestErr(msg string) *Resp {
+	return errResp("ERR T-Digest: " + msg)
+}
+
+// tdigestFloat renders an estimate, spelling an empty digest's NaN the way
+// RedisBloom does.
+func tdigestFloat(f float64) Resp {
+	if math.IsNaN(f) {
+		return Resp{sign: BulkString, bulk: "nan"}
+	}
+	return Resp{sign: BulkString, bulk: formatFloat(f)}
+}
+
+func parseCompression(s string) (float64, *Resp) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, tdigestErr("error parsing compression parameter")
+	}
+	if n <= 0 {
+		return 0, tdigestErr("compression parameter needs to be a positive integer")
+	}
+	return float64(n), nil
+}
+
+// tdigestForWrite returns the digest stored at k. Queries go through it
+// too, see tdigestForQuery, so every t-digest command holds db.mu for
+// writing.
+func tdigestForWrite(db *Database, k string) (*Item, *Resp) {
+	item, errReply := itemForWrite(db, k, TDigestType, false)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if item == nil {
+		return nil, tdigestErr("key does not exist")
+	}
+	return item, nil
+}
+
+// tdigestForQuery is tdigestForWrite for queries, which first fold the
+// buffered values into the centroids. The fold resizes the digest, so it
+// runs through Update to keep db.mem in step.
+func tdigestForQuery(db *Database, k string) (*Item, *Resp) {
+	item, errReply := tdigestForWrite(db, k)
+	if errReply != nil {
+		return nil, errReply
+	}
+	db.Update(k, item, item.T.compress)
+	return item, nil
+}
+
+// tdigestCreate implements TDIGEST.CREATE key [COMPRESSION compression].
+func tdigestCreate(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 && len(args) != 3 {
+		return argsErr("TDIGEST.CREATE")
+	}
+	k := args[0].bulk
+	compression := float64(defaultTDigestCompression)
+	if len(args) == 3 {
+		if strings.ToUpper(args[1].bulk) != "COMPRESSION" {
+			return syntaxErr()
+		}
+		var errReply *Resp
+		if compression, errReply = parseCompression(args[2].bulk); errReply != nil {
+			return errReply
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.Get(k); ok {
+		return tdigestErr("key already exists")
+	}
+	item := &Item{Type: TDigestType, T: NewTDigest(compression)}
+	if err := db.ensureMem(state, item.approxMemUsage(k)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	db.Put(k, item)
+	db.notify(notifyGeneric, "tdigest.create", k)
+	IncrRDBTracker()
+	return okResp()
+}
+
+// tdigestAdd implements TDIGEST.ADD key value [value ...].
+func tdigestAdd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("TDIGEST.ADD")
+	}
+	k := args[0].bulk
+	vals := make([]float64, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		v, ok := parseScore(arg.bulk)
+		if !ok {
+			return tdigestErr("error parsing val parameter")
+		}
+		vals = append(vals, v)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, int64(16*len(vals))); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := tdigestForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+	db.Update(k, item, func() {
+		for _, v := range vals {
+			item.T.Add(v)
+		}
+	})
+	db.notify(notifyGeneric, "tdigest.add", k)
+	IncrRDBTracker()
+	return okResp()
+}
+
+func tdigestReset(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("TDIGEST.RESET")
+	}
+	k := args[0].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := tdigestForWrite(db, k)
+	if errReply != nil {
+		return errReply
+	}
+	db.Update(k, item, item.T.Reset)
+	db.notify(notifyGeneric, "tdigest.reset", k)
+	IncrRDBTracker()
+	return okResp()
+}
+
+// tdigestMerge implements TDIGEST.MERGE destkey numkeys key [key ...]
+// [COMPRESSION compression] [OVERRIDE]. Unless OVERRIDE is given an
+// existing destination is merged in too. The compression defaults to the
+// largest among the inputs.
+func tdigestMerge(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 3 {
+		return argsErr("TDIGEST.MERGE")
+	}
+	dst := args[0].bulk
+	numkeys, err := strconv.Atoi(args[1].bulk)
+	if err != nil || numkeys <= 0 {
+		return tdigestErr("numkeys needs to be a positive integer")
+	}
+	if len(args) < 2+numkeys {
+		return syntaxErr()
+	}
+	srcs := args[2 : 2+numkeys]
+
+	var compression float64
+	var override bool
+	for i := 2 + numkeys; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "COMPRESSION":
+			if i+1 >= len(args) {
+				return syntaxErr()
+			}
+			var errReply *Resp
+			if compression, errReply = parseCompression(args[i+1].bulk); errReply != nil {
+				return errReply
+			}
+			i++
+		case "OVERRIDE":
+			override = true
+		default:
+			return syntaxErr()
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Make room before the lookups. The merged digest isn't built yet, so
+	// reserve the most a compressed one of its compression can take, less
+	// the digest it replaces.
+	if compression == 0 {
+		keys := srcs
+		if !override {
+			keys = append([]Resp{args[0]}, srcs...)
+		}
+		for _, k := range keys {
+			if item, ok := db.peek(k.bulk); ok && item.Type == TDigestType {
+				compression = math.Max(compression, item.T.compression)
+			}
+		}
+	}
+	required := NewTDigest(compression).maxMemUsage()
+	if item, ok := db.peek(dst); ok && item.Type == TDigestType {
+		required -= item.T.memUsage()
+	}
+	if err := db.ensureMem(state, required); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+
+	var inputs []*TDigest
+	for _, src := range srcs {
+		item, errReply := tdigestForWrite(db, src.bulk)
+		if errReply != nil {
+			return errReply
+		}
+		inputs = append(inputs, item.T)
+	}
+	dstItem, errReply := itemForWrite(db, dst, TDigestType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if dstItem != nil && !override {
+		inputs = append(inputs, dstItem.T)
+	}
+
+	merged := NewTDigest(compression)
+	for _, in := range inputs {
+		merged.Merge(in)
+	}
+	merged.compress()
+
+	if dstItem != nil {
+		db.Update(dst, dstItem, func() { dstItem.T = merged })
+	} else {
+		db.Put(dst, &Item{Type: TDigestType, T: merged})
+	}
+	db.notify(notifyGeneric, "tdigest.merge", dst)
+	IncrRDBTracker()
+	return okResp()
+}
+
+// tdigestQuery runs a query taking one or more numeric arguments after the
+// key against the digest, one reply element per argument. parse validates
+// an argument and returns the error reply for a bad one.
+func tdigestQuery(c *Client, r *Resp, cmd string, parse func(string) (float64, *Resp), query func(t *TDigest, x float64) Resp) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr(cmd)
+	}
+	xs := make([]float64, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		x, errReply := parse(arg.bulk)
+		if errReply != nil {
+			return errReply
+		}
+		xs = append(xs, x)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := tdigestForQuery(db, args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	reply := &Resp{sign: Array}
+	for _, x := range xs {
+		reply.arr = append(reply.arr, query(item.T, x))
+	}
+	return reply
+}
+
+func parseTDigestValue(s string) (float64, *Resp) {
+	v, ok := parseScore(s)
+	if !ok {
+		return 0, tdigestErr("error parsing value")
+	}
+	return v, nil
+}
+
+func parseTDigestRank(s string) (float64, *Resp) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, tdigestErr("error parsing rank")
+	}
+	if n < 0 {
+		return 0, tdigestErr("rank needs to be non negative")
+	}
+	return float64(n), nil
+}
+
+func tdigestQuantile(c *Client, r *Resp, state *AppState) *Resp {
+	parse := func(s string) (float64, *Resp) {
+		q, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, tdigestErr("error parsing quantile")
+		}
+		if !(q >= 0 && q <= 1) {
+			return 0, tdigestErr("quantile should be in [0,1]")
+		}
+		return q, nil
+	}
+	return tdigestQuery(c, r, "TDIGEST.QUANTILE", parse, func(t *TDigest, q float64) Resp {
+		return tdigestFloat(t.Quantile(q))
+	})
+}
+
+func tdigestCDF(c *Client, r *Resp, state *AppState) *Resp {
+	return tdigestQuery(c, r, "TDIGEST.CDF", parseTDigestValue, func(t *TDigest, x float64) Resp {
+		return tdigestFloat(t.CDF(x))
+	})
+}
+
+// halfRoundDown rounds to the nearest integer, taking ties downwards, so
+// the rank of a value seen once is the number of values below it.
+func halfRoundDown(x float64) int {
+	return int(math.Ceil(x - 0.5))
+}
+
+// tdigestRank implements TDIGEST.RANK and TDIGEST.REVRANK: the estimated
+// number of values below (above) each value, -1 for values beyond the
+// smallest (largest) one seen and -2 for an empty digest.
+func tdigestRank(c *Client, r *Resp, rev bool) *Resp {
+	cmd := "TDIGEST.RANK"
+	if rev {
+		cmd = "TDIGEST.REVRANK"
+	}
+	return tdigestQuery(c, r, cmd, parseTDigestValue, func(t *TDigest, x float64) Resp {
+		n := t.Count()
+		switch {
+		case n == 0:
+			return Resp{sign: Integer, num: -2}
+		case (!rev && x < t.min) || (rev && x > t.max):
+			return Resp{sign: Integer, num: -1}
+		case (!rev && x > t.max) || (rev && x < t.min):
+			return Resp{sign: Integer, num: int(n)}
+		}
+		below := t.CDF(x) * n
+		if rev {
+			return Resp{sign: Integer, num: halfRoundDown(n - below)}
+		}
+		return Resp{sign: Integer, num: halfRoundDown(below)}
+	})
+}
+
+func tdigestRankCmd(c *Client, r *Resp, state *AppState) *Resp {
+	return tdigestRank(c, r, false)
+}
+
+func tdigestRevRankCmd(c *Client, r *Resp, state *AppState) *Resp {
+	return tdigestRank(c, r, true)
+}
+
+// tdigestByRank implements TDIGEST.BYRANK and TDIGEST.BYREVRANK: the
+// estimated value with each rank, counting from the smallest (largest)
+// value, and inf (-inf) for ranks past the number of values.
+func tdigestByRank(c *Client, r *Resp, rev bool) *Resp {
+	cmd := "TDIGEST.BYRANK"
+	if rev {
+		cmd = "TDIGEST.BYREVRANK"
+	}
+	return tdigestQuery(c, r, cmd, parseTDigestRank, func(t *TDigest, rank float64) Resp {
+		n := t.Count()
+		switch {
+		case n == 0:
+			return tdigestFloat(math.NaN())
+		case rank >= n && rev:
+			return tdigestFloat(math.Inf(-1))
+		case rank >= n:
+			return tdigestFloat(math.Inf(1))
+		}
+		if rev {
+			rank = n - 1 - rank
+		}
+		switch rank {
+		case 0:
+			return tdigestFloat(t.min)
+		case n - 1:
+			return tdigestFloat(t.max)
+		}
+		return tdigestFloat(t.Quantile((rank + 0.5) / n))
+	})
+}
+
+func tdigestByRankCmd(c *Client, r *Resp, state *AppState) *Resp {
+	return tdigestByRank(c, r, false)
+}
+
+func tdigestByRevRankCmd(c *Client, r *Resp, state *AppState) *Resp {
+	return tdigestByRank(c, r, true)
+}
+
+// tdigestMinMax implements TDIGEST.MIN and TDIGEST.MAX.
+func tdigestMinMax(c *Client, r *Resp, max bool) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		if max {
+			return argsErr("TDIGEST.MAX")
+		}
+		return argsErr("TDIGEST.MIN")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := tdigestForWrite(db, args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	if item.T.Count() == 0 {
+		reply := tdigestFloat(math.NaN())
+		return &reply
+	}
+	if max {
+		return bulkResp(formatFloat(item.T.max))
+	}
+	return bulkResp(formatFloat(item.T.min))
+}
+
+func tdigestMin(c *Client, r *Resp, state *AppState) *Resp {
+	return tdigestMinMax(c, r, false)
+}
+
+func tdigestMax(c *Client, r *Resp, state *AppState) *Resp {
+	return tdigestMinMax(c, r, true)
+}
+
+// tdigestTrimmedMean implements TDIGEST.TRIMMED_MEAN key low high, the
+// mean of the values between two quantiles.
+func tdigestTrimmedMean(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("TDIGEST.TRIMMED_MEAN")
+	}
+	lo, err1 := strconv.ParseFloat(args[1].bulk, 64)
+	hi, err2 := strconv.ParseFloat(args[2].bulk, 64)
+	if err1 != nil || err2 != nil {
+		return tdigestErr("error parsing cut percentile")
+	}
+	if !(lo >= 0 && lo <= 1 && hi >= 0 && hi <= 1) {
+		return tdigestErr("low_cut_percentile and high_cut_percentile should be in [0,1]")
+	}
+	if lo >= hi {
+		return tdigestErr("low_cut_percentile should be lower than high_cut_percentile")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := tdigestForQuery(db, args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	reply := tdigestFloat(item.T.TrimmedMean(lo, hi))
+	return &reply
+}
+
+func tdigestInfo(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("TDIGEST.INFO")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := tdigestForWrite(db, args[0].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	t := item.T
+	fields := []struct {
+		name string
+		n    int
+	}{
+		{"Compression", int(t.compression)},
+		{"Capacity", t.capacity()},
+		{"Merged nodes", len(t.merged)},
+		{"Unmerged nodes", len(t.unmerged)},
+		{"Merged weight", int(t.mergedW)},
+		{"Unmerged weight", int(t.unmergedW)},
+		{"Observations", int(t.Count())},
+		{"Total compressions", t.compressions},
+		{"Memory usage", int(t.memUsage())},
+	}
+	reply := &Resp{sign: Array}
+	for _, f := range fields {
+		reply.arr = append(reply.arr,
+			Resp{sign: BulkString, bulk: f.name},
+			Resp{sign: Integer, num: f.n})
+	}
+	return reply
+}
+
+// tdigestRestore implements TDIGEST.RESTORE key compression min max
+// [mean weight ...], which replaces key with a digest made of the given
+// centroids. AOF rewrites use it to recreate digests.
+func tdigestRestore(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 4 || len(args)%2 != 0 {
+		return argsErr("TDIGEST.RESTORE")
+	}
+	k := args[0].bulk
+	compression, errReply := parseCompression(args[1].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	min, err1 := strconv.ParseFloat(args[2].bulk, 64)
+	max, err2 := strconv.ParseFloat(args[3].bulk, 64)
+	if err1 != nil || err2 != nil {
+		return tdigestErr("error parsing min or max")
+	}
+
+	t := NewTDigest(compression)
+	for i := 4; i < len(args); i += 2 {
+		mean, ok1 := parseScore(args[i].bulk)
+		weight, ok2 := parseScore(args[i+1].bulk)
+		if !ok1 || !ok2 || weight <= 0 {
+			return tdigestErr("error parsing centroid")
+		}
+		t.addWeighted(mean, weight)
+	}
+	if t.Count() > 0 {
+		t.min, t.max = min, max
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, t.memUsage()); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	db.Put(k, &Item{Type: TDigestType, T: t})
+	db.notify(notifyGeneric, "tdigest.restore", k)
+	IncrRDBTracker()
+	return okResp()
+}
+
+// ---------------------------------------------------------------------------
+// streams
+// ---------------------------------------------------------------------------
+
+func streamEntryResp(e streamEntry) Resp {
+	fields := Resp{sign: Null}
+	if e.fields != nil {
+		fields = *arrResp(e.fields)
+	}
+	return Resp{sign: Array, arr: []Resp{{sign: BulkString, bulk: e.id.String()}, fields}}
+}
+
+func streamEntriesResp(entries []streamEntry) *Resp {
+	reply := &Resp{sign: Array, arr: []Resp{}}
+	for _, e := range entries {
+		reply.arr = append(reply.arr, streamEntryResp(e))
+	}
+	return reply
+}
+
+// streamReadResp builds the reply of XREAD and XREADGROUP for one stream.
+func streamReadResp(k string, entries []streamEntry) Resp {
+	return Resp{sign: Array, arr: []Resp{{sign: BulkString, bulk: k}, *streamEntriesResp(entries)}}
+}
+
+func noGroupErr(k, group string) *Resp {
+	return errResp("NOGROUP No such key '" + k + "' or consumer group '" + group + "'")
+}
+
+// streamGroupFor returns the stream at k and its consumer group, with a
+// NOGROUP error when either is missing. The caller must hold db.mu.
+func streamGroupFor(db *Database, k, group string) (*Item, *streamGroup, *Resp) {
+	item, errReply := itemForWrite(db, k, StreamType, false)
+	if errReply != nil {
+		return nil, nil, errReply
+	}
+	if item == nil || item.X.groups[group] == nil {
+		return nil, nil, noGroupErr(k, group)
+	}
+	return item, item.X.groups[group], nil
+}
+
+// parseStreamTrim parses the MAXLEN|MINID [=|~] threshold [LIMIT count]
+// clause of XADD and XTRIM starting at args[i], and returns the index
+// after it.
+func parseStreamTrim(args []Resp, i int) (streamTrim, int, *Resp) {
+	t := streamTrim{minID: strings.ToUpper(args[i].bulk) == "MINID"}
+	i++
+	approx := false
+	if i < len(args) && (args[i].bulk == "~" || args[i].bulk == "=") {
+		approx = args[i].bulk == "~"
+		i++
+	}
+	if i >= len(args) {
+		return t, i, syntaxErr()
+	}
+	if t.minID {
+		id, err := parseStreamID(args[i].bulk, 0)
+		if err != nil {
+			return t, i, errResp(err.Error())
+		}
+		t.id = id
+	} else {
+		n, err := strconv.Atoi(args[i].bulk)
+		if err != nil {
+			return t, i, notIntErr()
+		}
+		if n < 0 {
+			return t, i, errResp("ERR The MAXLEN argument must be >= 0.")
+		}
+		t.maxLen = n
+	}
+	i++
+
+	if i+1 < len(args) && strings.ToUpper(args[i].bulk) == "LIMIT" {
+		if !approx {
+			return t, i, errResp("ERR syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		n, err := strconv.Atoi(args[i+1].bulk)
+		if err != nil || n < 0 {
+			return t, i, errResp("ERR The LIMIT argument must be >= 0.")
+		}
+		t.limit = n
+		i += 2
+	}
+	return t, i, nil
+}
+
+// xadd implements XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold
+// [LIMIT count]] *|id field value [field value ...]. Generated IDs are
+// written to the AOF in place of *, so replay recreates the same entries.
+func xadd(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 4 {
+		return argsErr("XADD")
+	}
+	k := args[0].bulk
+
+	var nomkstream bool
+	var trim *streamTrim
+	i := 1
+opts:
+	for i < len(args) {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NOMKSTREAM":
+			nomkstream = true
+			i++
+		case "MAXLEN", "MINID":
+			t, next, errReply := parseStreamTrim(args, i)
+			if errReply != nil {
+				return errReply
+			}
+			trim, i = &t, next
+		default:
+			break opts
+		}
+	}
+	if i >= len(args) || len(args)-i-1 == 0 || (len(args)-i-1)%2 != 0 {
+		return argsErr("XADD")
+	}
+	idArg := args[i].bulk
+	fields := bulkArgs(args[i+1:])
+
+	var id streamID
+	var ms uint64
+	auto, autoSeq := idArg == "*", false
+	if !auto {
+		var err error
+		if msPart, ok := strings.CutSuffix(idArg, "-*"); ok {
+			autoSeq = true
+			if ms, err = strconv.ParseUint(msPart, 10, 64); err != nil {
+				return errResp(errInvalidStreamID.Error())
+			}
+		} else if id, err = parseStreamID(idArg, 0); err != nil {
+			return errResp(err.Error())
+		} else if id == (streamID{}) {
+			return errResp("ERR The ID specified in XADD must be greater than 0-0")
+		}
+	}
+	var required int64 = 64
+	for _, f := range fields {
+		required += int64(len(f) + 16)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, required); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, StreamType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil && nomkstream {
+		return nullResp()
+	}
+
+	s := NewStream()
+	if item != nil {
+		s = item.X
+	}
+	if auto || autoSeq {
+		var err error
+		if id, err = s.nextID(ms, auto); err != nil {
+			return errResp(err.Error())
+		}
+	} else if !s.lastID.less(id) {
+		return errResp("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+
+	if item == nil {
+		item, _ = itemForWrite(db, k, StreamType, true)
+	}
+	db.Update(k, item, func() {
+		item.X.Add(id, fields)
+		db.notify(notifyStream, "xadd", k)
+		if trim != nil && item.X.Trim(*trim) > 0 {
+			db.notify(notifyStream, "xtrim", k)
+		}
+	})
+
+	logged := bulkArgs(r.arr)
+	logged[i+1] = id.String()
+	rewriteCommand(cmdResp(logged...))
+	IncrRDBTracker()
+
+	db.serveBlocked(k)
+	return bulkResp(id.String())
+}
+
+// xtrim implements XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count].
+func xtrim(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 3 {
+		return argsErr("XTRIM")
+	}
+	k := args[0].bulk
+	switch strings.ToUpper(args[1].bulk) {
+	case "MAXLEN", "MINID":
+	default:
+		return syntaxErr()
+	}
+	trim, next, errReply := parseStreamTrim(args, 1)
+	if errReply != nil {
+		return errReply
+	}
+	if next != len(args) {
+		return syntaxErr()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, StreamType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	var n int
+	db.Update(k, item, func() {
+		n = item.X.Trim(trim)
+	})
+	if n > 0 {
+		db.notify(notifyStream, "xtrim", k)
+		IncrRDBTracker()
+	}
+	return intResp(n)
+}
+
+func xlen(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("XLEN")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, StreamType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	return intResp(item.X.Len())
+}
+
+func xrange(c *Client, r *Resp, state *AppState) *Resp {
+	return xrangeGeneric(DBs[c.db], r, false)
+}
+
+func xrevrange(c *Client, r *Resp, state *AppState) *Resp {
+	return xrangeGeneric(DBs[c.db], r, true)
+}
+
+// xrangeGeneric implements XRANGE key start end [COUNT count] and XREVRANGE
+// key end start [COUNT count].
+func xrangeGeneric(db *Database, r *Resp, rev bool) *Resp {
+	args := r.arr[1:]
+	if len(args) != 3 && len(args) != 5 {
+		return argsErr(strings.ToUpper(r.arr[0].bulk))
+	}
+	lo, hi := args[1].bulk, args[2].bulk
+	if rev {
+		lo, hi = hi, lo
+	}
+	start, err := parseRangeID(lo, true)
+	if err != nil {
+		return errResp(err.Error())
+	}
+	end, err := parseRangeID(hi, false)
+	if err != nil {
+		return errResp(err.Error())
+	}
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3].bulk) != "COUNT" {
+			return syntaxErr()
+		}
+		if count, err = strconv.Atoi(args[4].bulk); err != nil {
+			return notIntErr()
+		}
+		if count <= 0 {
+			return arrResp(nil)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, StreamType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return arrResp(nil)
+	}
+	return streamEntriesResp(item.X.Range(start, end, rev, count))
+}
+
+func xdel(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("XDEL")
+	}
+	k := args[0].bulk
+	ids := make([]streamID, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, err := parseStreamID(arg.bulk, 0)
+		if err != nil {
+			return errResp(err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, StreamType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	var n int
+	db.Update(k, item, func() {
+		n = item.X.Delete(ids)
+	})
+	if n > 0 {
+		db.notify(notifyStream, "xdel", k)
+		IncrRDBTracker()
+	}
+	return intResp(n)
+}
+
+// xsetid implements XSETID key last-id [ENTRIESADDED n] [MAXDELETEDID id].
+// AOF rewrites use it to restore the last ID of a stream whose newest
+// entries were deleted. The options are accepted for compatibility.
+func xsetid(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 || len(args)%2 != 0 {
+		return argsErr("XSETID")
+	}
+	k := args[0].bulk
+	id, err := parseStreamID(args[1].bulk, 0)
+	if err != nil {
+		return errResp(err.Error())
+	}
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i].bulk) {
+		case "ENTRIESADDED", "MAXDELETEDID":
+		default:
+			return syntaxErr()
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, StreamType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return errResp("ERR no such key")
+	}
+	if n := item.X.Len(); n > 0 && id.less(item.X.entries[n-1].id) {
+		return errResp("ERR The ID specified in XSETID is smaller than the target stream top item")
+	}
+	item.X.lastID = id
+	db.notify(notifyStream, "xsetid", k)
+	IncrRDBTracker()
+	return okResp()
+}
+
+// parseStreamsClause splits the arguments after STREAMS into keys and IDs.
+func parseStreamsClause(args []Resp, cmd string) ([]string, []string, *Resp) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, nil, errResp("ERR Unbalanced '" + cmd + "' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	half := len(args) / 2
+	return bulkArgs(args[:half]), bulkArgs(args[half:]), nil
+}
+
+// parseBlockMs parses the BLOCK milliseconds of XREAD and XREADGROUP.
+func parseBlockMs(s string) (time.Duration, *Resp) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errResp("ERR timeout is not an integer or out of range")
+	}
+	if ms < 0 {
+		return 0, errResp("ERR timeout is negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// xread implements XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id
+// [id ...]. With BLOCK and nothing to return yet, it waits for an XADD to
+// any of the keys, $ standing for the last ID at the time of the call.
+func xread(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+
+	count, block := 0, false
+	var timeout time.Duration
+	i := 0
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		if opt == "STREAMS" {
+			break
+		}
+		if i+1 >= len(args) {
+			return syntaxErr()
+		}
+		switch opt {
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return notIntErr()
+			}
+			count = n
+		case "BLOCK":
+			var errReply *Resp
+			if timeout, errReply = parseBlockMs(args[i+1].bulk); errReply != nil {
+				return errReply
+			}
+			block = true
+		default:
+			return syntaxErr()
+		}
+		i++
+	}
+	if i >= len(args) {
+		return syntaxErr()
+	}
+	keys, idArgs, errReply := parseStreamsClause(args[i+1:], "xread")
+	if errReply != nil {
+		return errReply
+	}
+
+	db.mu.Lock()
+	ids := make([]streamID, len(keys))
+	reply := &Resp{sign: Array}
+	for j, k := range keys {
+		item, errReply := itemForRead(db, k, StreamType)
+		if errReply != nil {
+			db.mu.Unlock()
+			return errReply
+		}
+		switch idArgs[j] {
+		case "$":
+			if item != nil {
+				ids[j] = item.X.lastID
+			}
+		case ">":
+			db.mu.Unlock()
+			return errResp("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+		default:
+			id, err := parseStreamID(idArgs[j], 0)
+			if err != nil {
+				db.mu.Unlock()
+				return errResp(err.Error())
+			}
+			ids[j] = id
+		}
+		if item == nil {
+			continue
+		}
+		if entries := item.X.After(ids[j], count); len(entries) > 0 {
+			reply.arr = append(reply.arr, streamReadResp(k, entries))
+		}
+	}
+	if len(reply.arr) > 0 {
+		db.mu.Unlock()
+		return reply
+	}
+
+	// inside MULTI a blocking read behaves like its non-blocking form
+	if !block || c.tx != nil {
+		db.mu.Unlock()
+		return nullResp()
+	}
+
+	bc := &blockedClient{
+		keys: keys,
+		ch:   make(chan *Resp, 1),
+		serve: func(k string) *Resp {
+			item, ok := db.store[k]
+			if !ok || item.Type != StreamType {
+				return nil
+			}
+			entries := item.X.After(ids[slices.Index(keys, k)], count)
+			if len(entries) == 0 {
+				return nil
+			}
+			return &Resp{sign: Array, arr: []Resp{streamReadResp(k, entries)}}
+		},
+	}
+	db.block(bc)
+	db.mu.Unlock()
+
+	return db.waitBlocked(c, bc, timeout, state)
+}
+
+// propagateClaim logs pending entry pe of a consumer group the way Redis
+// propagates deliveries, as an XCLAIM that recreates it exactly, along with
+// the group's last delivered ID.
+func propagateClaim(db *Database, k, group string, g *streamGroup, pe *pendingEntry) {
+	alsoPropagate(db, cmdResp("XCLAIM", k, group, pe.consumer, "0", pe.id.String(),
+		"TIME", strconv.FormatInt(pe.delivered.UnixMilli(), 10),
+		"RETRYCOUNT", strconv.Itoa(pe.deliveries),
+		"FORCE", "JUSTID", "LASTID", g.lastID.String()))
+}
+
+// addConsumer registers consumer with group g of the stream item at k, and
+// reports whether it is new.
+func addConsumer(db *Database, k string, item *Item, group string, g *streamGroup, consumer string) bool {
+	var added bool
+	db.Update(k, item, func() { added = g.addConsumer(consumer) })
+	if !added {
+		return false
+	}
+	db.notify(notifyStream, "xgroup-createconsumer", k)
+	alsoPropagate(db, cmdResp("XGROUP", "CREATECONSUMER", k, group, consumer))
+	return true
+}
+
+// deliverNew hands up to count entries the group has not seen yet to
+// consumer, adding them to the group's PEL unless noack is set.
+func deliverNew(db *Database, k string, item *Item, group string, g *streamGroup, consumer string, count int, noack bool) []streamEntry {
+	entries := item.X.After(g.lastID, count)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	g.lastID = entries[len(entries)-1].id
+	if noack {
+		alsoPropagate(db, cmdResp("XGROUP", "SETID", k, group, g.lastID.String()))
+	}
+	if !noack {
+		db.Update(k, item, func() {
+			for _, e := range entries {
+				pe := &pendingEntry{id: e.id, consumer: consumer, delivered: now, deliveries: 1}
+				g.addPending(pe)
+				propagateClaim(db, k, group, g, pe)
+			}
+		})
+	}
+	db.touch(k)
+	IncrRDBTracker()
+	return entries
+}
+
+// xreadgroup implements XREADGROUP GROUP group consumer [COUNT count]
+// [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]. The ID > reads
+// entries never delivered to the group; any other ID rereads the
+// consumer's own pending entries after it. Only reads of new entries block.
+func xreadgroup(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 6 || strings.ToUpper(args[0].bulk) != "GROUP" {
+		return syntaxErr()
+	}
+	group, consumer := args[1].bulk, args[2].bulk
+
+	count, block, noack := 0, false, false
+	var timeout time.Duration
+	i := 3
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		if opt == "STREAMS" {
+			break
+		}
+		if opt == "NOACK" {
+			noack = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return syntaxErr()
+		}
+		switch opt {
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return notIntErr()
+			}
+			count = n
+		case "BLOCK":
+			var errReply *Resp
+			if timeout, errReply = parseBlockMs(args[i+1].bulk); errReply != nil {
+				return errReply
+			}
+			block = true
+		default:
+			return syntaxErr()
+		}
+		i++
+	}
+	if i >= len(args) {
+		return syntaxErr()
+	}
+	keys, idArgs, errReply := parseStreamsClause(args[i+1:], "xreadgroup")
+	if errReply != nil {
+		return errReply
+	}
+	ids := make([]streamID, len(keys))
+	for j, idArg := range idArgs {
+		switch idArg {
+		case ">":
+		case "$":
+			return errResp("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		default:
+			id, err := parseStreamID(idArg, 0)
+			if err != nil {
+				return errResp(err.Error())
+			}
+			ids[j] = id
+		}
+	}
+
+	// logged as the consumers and deliveries it makes, see propagateClaim
+	preventPropagation()
+	db.mu.Lock()
+	items := make([]*Item, len(keys))
+	groups := make([]*streamGroup, len(keys))
+	for j, k := range keys {
+		item, errReply := itemForWrite(db, k, StreamType, false)
+		if errReply != nil {
+			db.mu.Unlock()
+			return errReply
+		}
+		if item == nil || item.X.groups[group] == nil {
+			db.mu.Unlock()
+			return errResp(noGroupErr(k, group).err + " in XREADGROUP with GROUP option")
+		}
+		items[j], groups[j] = item, item.X.groups[group]
+	}
+
+	reply := &Resp{sign: Array}
+	onlyNew := true
+	for j, k := range keys {
+		g := groups[j]
+		addConsumer(db, k, items[j], group, g, consumer)
+		if idArgs[j] == ">" {
+			if entries := deliverNew(db, k, items[j], group, g, consumer, count, noack); len(entries) > 0 {
+				reply.arr = append(reply.arr, streamReadResp(k, entries))
+			}
+			continue
+		}
+
+		// the consumer's history, with deleted entries reported without
+		// their fields
+		onlyNew = false
+		var entries []streamEntry
+		for _, pe := range g.pel[g.pelIndex(ids[j]):] {
+			if count > 0 && len(entries) == count {
+				break
+			}
+			if pe.consumer != consumer || pe.id == ids[j] {
+				continue
+			}
+			e, ok := items[j].X.Get(pe.id)
+			if !ok {
+				e = streamEntry{id: pe.id}
+			}
+			entries = append(entries, e)
+		}
+		reply.arr = append(reply.arr, streamReadResp(k, entries))
+	}
+	if len(reply.arr) > 0 {
+		db.mu.Unlock()
+		return reply
+	}
+
+	if !block || !onlyNew || c.tx != nil {
+		db.mu.Unlock()
+		return nullResp()
+	}
+
+	bc := &blockedClient{
+		keys: keys,
+		ch:   make(chan *Resp, 1),
+		serve: func(k string) *Resp {
+			item, ok := db.store[k]
+			if !ok || item.Type != StreamType || item.X.groups[group] == nil {
+				return errResp("NOGROUP the consumer group this client was blocked on no longer exists")
+			}
+			g := item.X.groups[group]
+			addConsumer(db, k, item, group, g, consumer)
+			entries := deliverNew(db, k, item, group, g, consumer, count, noack)
+			if len(entries) == 0 {
+				return nil
+			}
+			return &Resp{sign: Array, arr: []Resp{streamReadResp(k, entries)}}
+		},
+	}
+	db.block(bc)
+	db.mu.Unlock()
+
+	return db.waitBlocked(c, bc, timeout, state)
+}
+
+// xgroup implements XGROUP CREATE, SETID, DESTROY, CREATECONSUMER and
+// DELCONSUMER.
+func xgroup(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 3 {
+		return argsErr("XGROUP")
+	}
+	sub := strings.ToUpper(args[0].bulk)
+	k, group := args[1].bulk, args[2].bulk
+
+	var idArg, consumer string
+	var mkstream bool
+	switch sub {
+	case "CREATE", "SETID":
+		if len(args) < 4 {
+			return argsErr("XGROUP")
+		}
+		idArg = args[3].bulk
+		for i := 4; i < len(args); i++ {
+			switch opt := strings.ToUpper(args[i].bulk); {
+			case opt == "MKSTREAM" && sub == "CREATE":
+				mkstream = true
+			case opt == "ENTRIESREAD" && i+1 < len(args):
+				if _, err := strconv.ParseInt(args[i+1].bulk, 10, 64); err != nil {
+					return notIntErr()
+				}
+				i++
+			default:
+				return syntaxErr()
+			}
+		}
+	case "CREATECONSUMER", "DELCONSUMER":
+		if len(args) != 4 {
+			return argsErr("XGROUP")
+		}
+		consumer = args[3].bulk
+	case "DESTROY":
+		if len(args) != 3 {
+			return argsErr("XGROUP")
+		}
+	default:
+		return errResp("ERR unknown subcommand '" + args[0].bulk + "'. Try XGROUP HELP.")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, StreamType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil && !mkstream {
+		return errResp("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+
+	// $ is resolved before logging, so replay does not depend on timing
+	var id streamID
+	if idArg == "$" {
+		if item != nil {
+			id = item.X.lastID
+		}
+	} else if idArg != "" {
+		var err error
+		if id, err = parseStreamID(idArg, 0); err != nil {
+			return errResp(err.Error())
+		}
+	}
+	logged := bulkArgs(r.arr)
+	if idArg != "" {
+		logged[4] = id.String()
+	}
+
+	var g *streamGroup
+	if item != nil {
+		g = item.X.groups[group]
+	}
+	if g == nil && sub != "CREATE" {
+		return errResp("NOGROUP No such consumer group '" + group + "' for key name '" + k + "'")
+	}
+
+	var reply *Resp
+	switch sub {
+	case "CREATE":
+		if g != nil {
+			return errResp("BUSYGROUP Consumer Group name already exists")
+		}
+		if item == nil {
+			item, _ = itemForWrite(db, k, StreamType, true)
+		}
+		db.Update(k, item, func() {
+			item.X.addGroup(group, id)
+		})
+		db.notify(notifyStream, "xgroup-create", k)
+		reply = okResp()
+	case "SETID":
+		g.lastID = id
+		db.notify(notifyStream, "xgroup-setid", k)
+		reply = okResp()
+	case "DESTROY":
+		db.Update(k, item, func() {
+			item.X.deleteGroup(group)
+		})
+		db.notify(notifyStream, "xgroup-destroy", k)
+		// clients blocked reading through the group get an error
+		db.serveBlocked(k)
+		reply = intResp(1)
+	case "CREATECONSUMER":
+		var added bool
+		db.Update(k, item, func() { added = g.addConsumer(consumer) })
+		if !added {
+			return intResp(0)
+		}
+		db.notify(notifyStream, "xgroup-createconsumer", k)
+		reply = intResp(1)
+	case "DELCONSUMER":
+		if _, ok := g.consumers[consumer]; !ok {
+			return intResp(0)
+		}
+		var n int
+		db.Update(k, item, func() {
+			n = g.deleteConsumer(consumer)
+		})
+		db.notify(notifyStream, "xgroup-delconsumer", k)
+		reply = intResp(n)
+	}
+	rewriteCommand(cmdResp(logged...))
+	IncrRDBTracker()
+	return reply
+}
+
+// xack implements XACK key group id [id ...], removing entries from the
+// group's PEL.
+func xack(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 3 {
+		return argsErr("XACK")
+	}
+	k, group := args[0].bulk, args[1].bulk
+	ids := make([]streamID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, err := parseStreamID(arg.bulk, 0)
+		if err != nil {
+			return errResp(err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForWrite(db, k, StreamType, false)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil || item.X.groups[group] == nil {
+		return intResp(0)
+	}
+	g := item.X.groups[group]
+	n := 0
+	db.Update(k, item, func() {
+		for _, id := range ids {
+			if g.removePending(id) {
+				n++
+			}
+		}
+	})
+	if n > 0 {
+		db.touch(k)
+		IncrRDBTracker()
+	}
+	return intResp(n)
+}
+
+// xpending implements XPENDING key group [[IDLE min-idle] start end count
+// [consumer]]. Without a range it summarises the group's PEL.
+func xpending(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("XPENDING")
+	}
+	k, group := args[0].bulk, args[1].bulk
+
+	extended := len(args) > 2
+	var minIdle int64
+	var start, end streamID
+	var count int
+	var consumer string
+	if extended {
+		rest := args[2:]
+		if strings.ToUpper(rest[0].bulk) == "IDLE" {
+			if len(rest) < 2 {
+				return syntaxErr()
+			}
+			n, err := strconv.ParseInt(rest[1].bulk, 10, 64)
+			if err != nil {
+				return notIntErr()
+			}
+			minIdle, rest = n, rest[2:]
+		}
+		if len(rest) != 3 && len(rest) != 4 {
+			return syntaxErr()
+		}
+		var err error
+		if start, err = parseRangeID(rest[0].bulk, true); err != nil {
+			return errResp(err.Error())
+		}
+		if end, err = parseRangeID(rest[1].bulk, false); err != nil {
+			return errResp(err.Error())
+		}
+		if count, err = strconv.Atoi(rest[2].bulk); err != nil {
+			return notIntErr()
+		}
+		if len(rest) == 4 {
+			consumer = rest[3].bulk
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, k, StreamType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil || item.X.groups[group] == nil {
+		return noGroupErr(k, group)
+	}
+	g := item.X.groups[group]
+
+	if !extended {
+		if len(g.pel) == 0 {
+			return &Resp{sign: Array, arr: []Resp{{sign: Integer, num: 0}, {sign: Null}, {sign: Null}, {sign: Null}}}
+		}
+		perConsumer := map[string]int{}
+		for _, pe := range g.pel {
+			perConsumer[pe.consumer]++
+		}
+		names := make([]string, 0, len(perConsumer))
+		for name := range perConsumer {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		consumers := Resp{sign: Array}
+		for _, name := range names {
+			consumers.arr = append(consumers.arr, *arrResp([]string{name, strconv.Itoa(perConsumer[name])}))
+		}
+		return &Resp{sign: Array, arr: []Resp{
+			{sign: Integer, num: len(g.pel)},
+			{sign: BulkString, bulk: g.pel[0].id.String()},
+			{sign: BulkString, bulk: g.pel[len(g.pel)-1].id.String()},
+			consumers,
+		}}
+	}
+
+	now := time.Now()
+	reply := &Resp{sign: Array, arr: []Resp{}}
+	for _, pe := range g.pel[g.pelIndex(start):] {
+		if len(reply.arr) >= count || end.less(pe.id) {
+			break
+		}
+		if (consumer != "" && pe.consumer != consumer) || pe.idle(now) < minIdle {
+			continue
+		}
+		reply.arr = append(reply.arr, Resp{sign: Array, arr: []Resp{
+			{sign: BulkString, bulk: pe.id.String()},
+			{sign: BulkString, bulk: pe.consumer},
+			{sign: Integer, num: int(pe.idle(now))},
+			{sign: Integer, num: pe.deliveries},
+		}})
+	}
+	return reply
+}
+
+// xclaim implements XCLAIM key group consumer min-idle id [id ...] [IDLE
+// ms] [TIME unix-ms] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id],
+// transferring pending entries idle for at least min-idle to consumer.
+func xclaim(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 5 {
+		return argsErr("XCLAIM")
+	}
+	k, group, consumer := args[0].bulk, args[1].bulk, args[2].bulk
+	minIdle, err := strconv.ParseInt(args[3].bulk, 10, 64)
+	if err != nil || minIdle < 0 {
+		return errResp("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+
+	// IDs run up to the first option
+	var ids []streamID
+	i := 4
+	for ; i < len(args); i++ {
+		id, err := parseStreamID(args[i].bulk, 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return errResp(errInvalidStreamID.Error())
+	}
+
+	now := time.Now()
+	delivered := now
+	retryCount := -1
+	var force, justID bool
+	var lastID *streamID
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		switch opt {
+		case "FORCE":
+			force = true
+			continue
+		case "JUSTID":
+			justID = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return syntaxErr()
+		}
+		val := args[i+1].bulk
+		i++
+		switch opt {
+		case "IDLE", "TIME":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return errResp("ERR Invalid " + opt + " option argument for XCLAIM")
+			}
+			if opt == "IDLE" {
+				delivered = now.Add(-time.Duration(n) * time.Millisecond)
+			} else {
+				delivered = time.UnixMilli(n)
+			}
+		case "RETRYCOUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return errResp("ERR Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+			retryCount = n
+		case "LASTID":
+			id, err := parseStreamID(val, 0)
+			if err != nil {
+				return errResp(err.Error())
+			}
+			lastID = &id
+		default:
+			return syntaxErr()
+		}
+	}
+	// a delivery time in the future makes no sense
+	if delivered.After(now) {
+		delivered = now
+	}
+
+	// logged as the claims it makes, see propagateClaim
+	preventPropagation()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, g, errReply := streamGroupFor(db, k, group)
+	if errReply != nil {
+		return errReply
+	}
+	addConsumer(db, k, item, group, g, consumer)
+	if lastID != nil && g.lastID.less(*lastID) {
+		g.lastID = *lastID
+	}
+
+	reply := &Resp{sign: Array, arr: []Resp{}}
+	var claimed []*pendingEntry
+	db.Update(k, item, func() {
+		for _, id := range ids {
+			pe := g.pending[id]
+			e, exists := item.X.Get(id)
+			if pe == nil {
+				if !force || !exists {
+					continue
+				}
+				pe = &pendingEntry{id: id, consumer: consumer, delivered: now}
+				g.addPending(pe)
+			} else if !exists {
+				g.removePending(id)
+				continue
+			}
+			if minIdle > 0 && pe.idle(now) < minIdle {
+				continue
+			}
+
+			pe.consumer = consumer
+			pe.delivered = delivered
+			if retryCount >= 0 {
+				pe.deliveries = retryCount
+			} else if !justID {
+				pe.deliveries++
+			}
+			claimed = append(claimed, pe)
+			if justID {
+				reply.arr = append(reply.arr, Resp{sign: BulkString, bulk: id.String()})
+			} else {
+				reply.arr = append(reply.arr, streamEntryResp(e))
+			}
+		}
+	})
+
+	for _, pe := range claimed {
+		propagateClaim(db, k, group, g, pe)
+	}
+	if len(claimed) == 0 && lastID != nil {
+		alsoPropagate(db, cmdResp("XGROUP", "SETID", k, group, g.lastID.String()))
+	}
+	db.touch(k)
+	IncrRDBTracker()
+	return reply
+}
+
+// xautoclaim implements XAUTOCLAIM key group consumer min-idle start
+// [COUNT count] [JUSTID]. It scans the PEL from start and claims entries
+// idle for at least min-idle, replying with the ID to continue from, the
+// claimed entries and the IDs of pending entries whose stream entry was
+// deleted, which it drops from the PEL.
+func xautoclaim(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 5 {
+		return argsErr("XAUTOCLAIM")
+	}
+	k, group, consumer := args[0].bulk, args[1].bulk, args[2].bulk
+	minIdle, err := strconv.ParseInt(args[3].bulk, 10, 64)
+	if err != nil || minIdle < 0 {
+		return errResp("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	start, err := parseRangeID(args[4].bulk, true)
+	if err != nil {
+		return errResp(err.Error())
+	}
+	count, justID := 100, false
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return syntaxErr()
+			}
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil || n < 1 {
+				return errResp("ERR COUNT must be > 0")
+			}
+			count = n
+			i++
+		case "JUSTID":
+			justID = true
+		default:
+			return syntaxErr()
+		}
+	}
+
+	// logged as the claims it makes, see propagateClaim
+	preventPropagation()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, g, errReply := streamGroupFor(db, k, group)
+	if errReply != nil {
+		return errReply
+	}
+	addConsumer(db, k, item, group, g, consumer)
+
+	now := time.Now()
+	claimedResp := Resp{sign: Array, arr: []Resp{}}
+	var claimed []*pendingEntry
+	var deleted []string
+	next := streamID{}
+	db.Update(k, item, func() {
+		// like Redis, look at no more than ten entries per entry asked for
+		attempts := count * 10
+		i := g.pelIndex(start)
+		for ; i < len(g.pel) && attempts > 0 && len(claimed) < count; attempts-- {
+			pe := g.pel[i]
+			e, exists := item.X.Get(pe.id)
+			if !exists {
+				deleted = append(deleted, pe.id.String())
+				g.removePending(pe.id)
+				continue
+			}
+			i++
+			if pe.idle(now) < minIdle {
+				continue
+			}
+
+			pe.consumer = consumer
+			pe.delivered = now
+			if !justID {
+				pe.deliveries++
+			}
+			claimed = append(claimed, pe)
+			if justID {
+				claimedResp.arr = append(claimedResp.arr, Resp{sign: BulkString, bulk: pe.id.String()})
+			} else {
+				claimedResp.arr = append(claimedResp.arr, streamEntryResp(e))
+			}
+		}
+		if i < len(g.pel) {
+			next = g.pel[i].id
+		}
+	})
+
+	for _, pe := range claimed {
+		propagateClaim(db, k, group, g, pe)
+	}
+	if len(deleted) > 0 {
+		alsoPropagate(db, cmdResp(append([]string{"XACK", k, group}, deleted...)...))
+	}
+	if len(claimed)+len(deleted) > 0 {
+		db.touch(k)
+		IncrRDBTracker()
+	}
+	return &Resp{sign: Array, arr: []Resp{
+		{sign: BulkString, bulk: next.String()},
+		claimedResp,
+		*arrResp(deleted),
+	}}
+}
+
+// ---------------------------------------------------------------------------
+// roaring bitmaps
+// ---------------------------------------------------------------------------
+
+// parseBitOffset parses a roaring bitmap offset, any uint32.
+func parseBitOffset(s string) (uint32, *Resp) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, errResp("ERR bit offset is not an integer or out of range")
+	}
+	return uint32(n), nil
+}
+
+// rsetbit implements R.SETBIT key offset value, replying with the bit's
+// previous value. Clearing a bit of a missing key does not create it.
+func rsetbit(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 {
+		return argsErr("R.SETBIT")
+	}
+	k := args[0].bulk
+	offset, errReply := parseBitOffset(args[1].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	if args[2].bulk != "0" && args[2].bulk != "1" {
+		return errResp("ERR bit is not an integer or out of range")
+	}
+	set := args[2].bulk == "1"
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, 2); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, RoaringType, set)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+
+	var changed bool
+	db.Update(k, item, func() {
+		if set {
+			changed = item.R.Add(offset)
+		} else {
+			changed = item.R.Remove(offset)
+		}
+		if changed {
+			db.notify(notifyGeneric, "r.setbit", k)
+		}
+	})
+	// the bit was set before exactly when setting it changed nothing or
+	// clearing it did
+	old := 0
+	if changed != set {
+		old = 1
+	}
+	if changed {
+		IncrRDBTracker()
+	}
+	return intResp(old)
+}
+
+func rgetbit(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 2 {
+		return argsErr("R.GETBIT")
+	}
+	offset, errReply := parseBitOffset(args[1].bulk)
+	if errReply != nil {
+		return errReply
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, RoaringType)
+	if errReply != nil {
+		return errReply
+	}
+	if item != nil && item.R.Contains(offset) {
+		return intResp(1)
+	}
+	return intResp(0)
+}
+
+func rcard(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 1 {
+		return argsErr("R.CARD")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, RoaringType)
+	if errReply != nil {
+		return errReply
+	}
+	if item == nil {
+		return intResp(0)
+	}
+	return intResp(item.R.Card())
+}
+
+// rrange implements R.RANGE key start end [COUNT count], the set offsets
+// between start and end inclusive, in ascending order. A bitmap can hold
+// billions of offsets, so large ones should be read in pages of COUNT,
+// starting each page one past the last offset of the previous one.
+func rrange(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) != 3 && len(args) != 5 {
+		return argsErr("R.RANGE")
+	}
+	start, errReply := parseBitOffset(args[1].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	end, errReply := parseBitOffset(args[2].bulk)
+	if errReply != nil {
+		return errReply
+	}
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3].bulk) != "COUNT" {
+			return syntaxErr()
+		}
+		var err error
+		if count, err = strconv.Atoi(args[4].bulk); err != nil {
+			return notIntErr()
+		}
+		if count <= 0 {
+			return arrResp(nil)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	item, errReply := itemForRead(db, args[0].bulk, RoaringType)
+	if errReply != nil {
+		return errReply
+	}
+	res := &Resp{sign: Array, arr: []Resp{}}
+	if item == nil || start > end {
+		return res
+	}
+	item.R.Range(start, end, func(x uint32) bool {
+		res.arr = append(res.arr, Resp{sign: Integer, num: int(x)})
+		return len(res.arr) != count
+	})
+	return res
+}
+
+var roaringOps = map[string]func(a, b *RoaringBitmap) *RoaringBitmap{
+	"AND":    (*RoaringBitmap).And,
+	"OR":     (*RoaringBitmap).Or,
+	"XOR":    (*RoaringBitmap).Xor,
+	"ANDNOT": (*RoaringBitmap).AndNot,
+}
+
+// rbitop implements R.BITOP AND|OR|XOR|ANDNOT destkey key [key ...],
+// folding the operation over the keys from left to right, so ANDNOT keeps
+// the offsets of the first key set in none of the others. Missing keys
+// are empty bitmaps. The result replaces destkey, which is deleted when
+// the result is empty, and the reply is its cardinality.
+func rbitop(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 3 {
+		return argsErr("R.BITOP")
+	}
+	op, ok := roaringOps[strings.ToUpper(args[0].bulk)]
+	if !ok {
+		return syntaxErr()
+	}
+	dst := args[1].bulk
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var res *RoaringBitmap
+	for i, arg := range args[2:] {
+		item, errReply := itemForWrite(db, arg.bulk, RoaringType, false)
+		if errReply != nil {
+			return errReply
+		}
+		src := NewRoaringBitmap()
+		if item != nil {
+			src = item.R
+		}
+		if i == 0 {
+			res = src.clone()
+		} else {
+			res = op(res, src)
+		}
+	}
+
+	item := &Item{Type: RoaringType, R: res}
+	if err := db.ensureMem(state, item.approxMemUsage(dst)); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	if res.Card() == 0 {
+		db.Delete(dst)
+	} else {
+		db.Put(dst, item)
+		db.notify(notifyGeneric, "r.bitop", dst)
+	}
+	IncrRDBTracker()
+	return intResp(res.Card())
+}
+
+// rappendintarray implements R.APPENDINTARRAY key offset [offset ...],
+// setting every given bit. The AOF rewrite restores bitmaps with it.
+func rappendintarray(c *Client, r *Resp, state *AppState) *Resp {
+	db := DBs[c.db]
+	args := r.arr[1:]
+	if len(args) < 2 {
+		return argsErr("R.APPENDINTARRAY")
+	}
+	k := args[0].bulk
+	offsets := make([]uint32, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		offset, errReply := parseBitOffset(arg.bulk)
+		if errReply != nil {
+			return errReply
+		}
+		offsets = append(offsets, offset)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.ensureMem(state, int64(2*len(offsets))); err != nil {
+		return errResp("ERR " + err.Error())
+	}
+	item, errReply := itemForWrite(db, k, RoaringType, true)
+	if errReply != nil {
+		return errReply
+	}
+	db.Update(k, item, func() {
+		for _, offset := range offsets {
+			item.R.Add(offset)
+		}
+	})
+	db.notify(notifyGeneric, "r.appendintarray", k)
+	IncrRDBTracker()
+	return okResp()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// HashMap maps fields to values and keeps a running total of their size so
+// memory accounting stays O(1).
+type HashMap struct {
+	m    map[string]string
+	size int64 // total bytes held by fields and values
+}
+
+func NewHashMap() *HashMap {
+	return &HashMap{m: map[string]string{}}
+}
+
+func (h *HashMap) Len() int {
+	return len(h.m)
+}
+
+func (h *HashMap) Get(f string) (string, bool) {
+	v, ok := h.m[f]
+	return v, ok
+}
+
+// Set stores v under f and reports whether f is a new field.
+func (h *HashMap) Set(f, v string) bool {
+	old, ok := h.m[f]
+	if ok {
+		h.size -= int64(len(old))
+	} else {
+		h.size += int64(len(f))
+	}
+	h.m[f] = v
+	h.size += int64(len(v))
+	return !ok
+}
+
+func (h *HashMap) Delete(f string) bool {
+	v, ok := h.m[f]
+	if !ok {
+		return false
+	}
+	delete(h.m, f)
+	h.size -= int64(len(f) + len(v))
+	return true
+}
+
+func (h *HashMap) memUsage() int64 {
+	stringHeader := 16
+	mapEntrySize := 32
+	return int64(len(h.m)*(2*stringHeader+mapEntrySize)) + h.size
+}
+
+func (h *HashMap) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(h.m)
+	return buf.Bytes(), err
+}
+
+func (h *HashMap) GobDecode(data []byte) error {
+	m := map[string]string{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&m); err != nil {
+		return err
+	}
+	h.m = map[string]string{}
+	h.size = 0
+	for f, v := range m {
+		h.Set(f, v)
+	}
+	return nil
+}
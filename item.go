@@ -1,16 +1,198 @@
 package main
 
-import "time"
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+type ItemType int
+
+const (
+	StringType ItemType = iota
+	ListType
+	HashType
+	SetType
+	ZSetType
+	TDigestType
+	StreamType
+	RoaringType
+)
+
+func (t ItemType) String() string {
+	switch t {
+	case ListType:
+		return "list"
+	case HashType:
+		return "hash"
+	case SetType:
+		return "set"
+	case ZSetType:
+		return "zset"
+	case TDigestType:
+		return "TDIS-TYPE"
+	case StreamType:
+		return "stream"
+	case RoaringType:
+		return "roaring"
+	default:
+		return "string"
+	}
+}
 
 type Item struct {
+	Type        ItemType
 	V           string
+	L           *List
+	H           *HashMap
+	S           *HashSet
+	Z           *ZSet
+	T           *TDigest
+	X           *Stream
+	R           *RoaringBitmap
 	Exp         time.Time
 	LastAccess  time.Time
 	AccessCount int
 }
 
+// NewItem returns an empty value of the given type.
+func NewItem(typ ItemType) *Item {
+	switch typ {
+	case ListType:
+		return &Item{Type: ListType, L: NewList()}
+	case HashType:
+		return &Item{Type: HashType, H: NewHashMap()}
+	case SetType:
+		return &Item{Type: SetType, S: NewHashSet()}
+	case ZSetType:
+		return &Item{Type: ZSetType, Z: NewZSet()}
+	case TDigestType:
+		return &Item{Type: TDigestType, T: NewTDigest(defaultTDigestCompression)}
+	case StreamType:
+		return &Item{Type: StreamType, X: NewStream()}
+	case RoaringType:
+		return &Item{Type: RoaringType, R: NewRoaringBitmap()}
+	default:
+		return &Item{Type: StringType}
+	}
+}
+
+// expiryAt converts an expiry argument into an absolute time. EX and PX
+// are relative to now, EXAT and PXAT are Unix timestamps. ok is false when
+// the result does not fit in a millisecond timestamp.
+func expiryAt(unit string, n int64) (t time.Time, ok bool) {
+	ms := n
+	if unit == "EX" || unit == "EXAT" {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return time.Time{}, false
+		}
+		ms = n * 1000
+	}
+	if unit == "EX" || unit == "PX" {
+		now := time.Now().UnixMilli()
+		if ms > math.MaxInt64-now || ms < math.MinInt64+now {
+			return time.Time{}, false
+		}
+		ms += now
+	}
+	return time.UnixMilli(ms), true
+}
+
+func (item *Item) hasExpiry() bool {
+	return item.Exp.Unix() != UNIX_TS_EPOCH
+}
+
 func (item *Item) shouldExpire() bool {
-	return item.Exp.Unix() != UNIX_TS_EPOCH && time.Until(item.Exp).Seconds() <= 0
+	return item.hasExpiry() && time.Until(item.Exp).Seconds() <= 0
+}
+
+// clone returns a deep copy of the item, as COPY stores it.
+func (item *Item) clone() *Item {
+	cp := NewItem(item.Type)
+	cp.V = item.V
+	cp.Exp = item.Exp
+	switch item.Type {
+	case ListType:
+		for _, v := range item.L.Values() {
+			cp.L.PushBack(v)
+		}
+	case HashType:
+		for f, v := range item.H.m {
+			cp.H.Set(f, v)
+		}
+	case SetType:
+		for _, m := range item.S.members {
+			cp.S.Add(m)
+		}
+	case ZSetType:
+		for m, score := range item.Z.dict {
+			cp.Z.Add(m, score)
+		}
+	case TDigestType:
+		cp.T = item.T.clone()
+	case StreamType:
+		cp.X = item.X.clone()
+	case RoaringType:
+		cp.R = item.R.clone()
+	}
+	return cp
+}
+
+// encoding names the internal representation reported by OBJECT ENCODING.
+func (item *Item) encoding() string {
+	switch item.Type {
+	case ListType:
+		return "quicklist"
+	case HashType, SetType:
+		return "hashtable"
+	case ZSetType:
+		return "skiplist"
+	case TDigestType:
+		return "raw"
+	case StreamType:
+		return "stream"
+	case RoaringType:
+		return "raw"
+	default:
+		if isIntEncoded(item.V) {
+			return "int"
+		}
+		// Redis embeds short strings in the object header
+		if len(item.V) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	}
+}
+
+// empty reports whether a container item has no elements left. Redis never
+// keeps empty containers around, so such items are deleted.
+func (item *Item) empty() bool {
+	switch item.Type {
+	case ListType:
+		return item.L.Len() == 0
+	case HashType:
+		return item.H.Len() == 0
+	case SetType:
+		return item.S.Len() == 0
+	case ZSetType:
+		return item.Z.Len() == 0
+	case RoaringType:
+		return item.R.Card() == 0
+	default:
+		return false
+	}
+}
+
+// isIntEncoded reports whether a string value is a canonical 64-bit
+// integer. Like Redis, such values are accounted as a bare int64 rather
+// than as a string header plus bytes.
+func isIntEncoded(v string) bool {
+	if len(v) == 0 || len(v) > 20 {
+		return false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return err == nil && strconv.FormatInt(n, 10) == v
 }
 
 func (item *Item) approxMemUsage(name string) int64 {
@@ -18,5 +200,26 @@ func (item *Item) approxMemUsage(name string) int64 {
 	expHeader := 24
 	mapEntrySize := 32
 
-	return int64(stringHeader + len(name) + stringHeader + len(item.V) + expHeader + mapEntrySize)
+	base := int64(stringHeader + len(name) + expHeader + mapEntrySize)
+	switch item.Type {
+	case ListType:
+		return base + item.L.memUsage()
+	case HashType:
+		return base + item.H.memUsage()
+	case SetType:
+		return base + item.S.memUsage()
+	case ZSetType:
+		return base + item.Z.memUsage()
+	case TDigestType:
+		return base + item.T.memUsage()
+	case StreamType:
+		return base + item.X.memUsage()
+	case RoaringType:
+		return base + item.R.memUsage()
+	default:
+		if isIntEncoded(item.V) {
+			return base + 8
+		}
+		return base + int64(stringHeader+len(item.V))
+	}
 }
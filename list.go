@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// List is a double-ended queue of strings backed by a ring buffer, so pushes
+// and pops at either end are amortised O(1).
+type List struct {
+	buf  []string
+	head int
+	n    int
+	size int64 // total bytes held by the elements
+}
+
+func NewList() *List {
+	return &List{}
+}
+
+func (l *List) Len() int {
+	return l.n
+}
+
+func (l *List) grow() {
+	if l.n < len(l.buf) {
+		return
+	}
+	newCap := len(l.buf) * 2
+	if newCap == 0 {
+		newCap = 4
+	}
+	buf := make([]string, newCap)
+	for i := 0; i < l.n; i++ {
+		buf[i] = l.buf[(l.head+i)%len(l.buf)]
+	}
+	l.buf = buf
+	l.head = 0
+}
+
+func (l *List) PushFront(v string) {
+	l.grow()
+	l.head = (l.head - 1 + len(l.buf)) % len(l.buf)
+	l.buf[l.head] = v
+	l.n++
+	l.size += int64(len(v))
+}
+
+func (l *List) PushBack(v string) {
+	l.grow()
+	l.buf[(l.head+l.n)%len(l.buf)] = v
+	l.n++
+	l.size += int64(len(v))
+}
+
+func (l *List) PopFront() (string, bool) {
+	if l.n == 0 {
+		return "", false
+	}
+	v := l.buf[l.head]
+	l.buf[l.head] = ""
+	l.head = (l.head + 1) % len(l.buf)
+	l.n--
+	l.size -= int64(len(v))
+	return v, true
+}
+
+func (l *List) PopBack() (string, bool) {
+	if l.n == 0 {
+		return "", false
+	}
+	i := (l.head + l.n - 1) % len(l.buf)
+	v := l.buf[i]
+	l.buf[i] = ""
+	l.n--
+	l.size -= int64(len(v))
+	return v, true
+}
+
+// normIndex turns a Redis style index (negative counts from the tail) into
+// an offset from the head. ok is false when the index is out of range.
+func (l *List) normIndex(i int) (int, bool) {
+	if i < 0 {
+		i += l.n
+	}
+	if i < 0 || i >= l.n {
+		return 0, false
+	}
+	return i, true
+}
+
+func (l *List) Index(i int) (string, bool) {
+	i, ok := l.normIndex(i)
+	if !ok {
+		return "", false
+	}
+	return l.buf[(l.head+i)%len(l.buf)], true
+}
+
+func (l *List) Set(i int, v string) bool {
+	i, ok := l.normIndex(i)
+	if !ok {
+		return false
+	}
+	pos := (l.head + i) % len(l.buf)
+	l.size += int64(len(v) - len(l.buf[pos]))
+	l.buf[pos] = v
+	return true
+}
+
+// clampRange converts an inclusive Redis style [start, stop] range into
+// head offsets. ok is false when the range selects nothing.
+func clampRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+func (l *List) Range(start, stop int) []string {
+	start, stop, ok := clampRange(start, stop, l.n)
+	if !ok {
+		return nil
+	}
+	vals := make([]string, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		vals = append(vals, l.buf[(l.head+i)%len(l.buf)])
+	}
+	return vals
+}
+
+func (l *List) Values() []string {
+	return l.Range(0, -1)
+}
+
+func (l *List) reset(vals []string) {
+	l.buf = nil
+	l.head = 0
+	l.n = 0
+	l.size = 0
+	for _, v := range vals {
+		l.PushBack(v)
+	}
+}
+
+// Trim keeps only the elements in the inclusive range [start, stop].
+func (l *List) Trim(start, stop int) {
+	l.reset(l.Range(start, stop))
+}
+
+// Remove deletes up to count occurrences of v. A positive count scans from
+// head to tail, a negative one from tail to head and zero removes them all.
+func (l *List) Remove(count int, v string) int {
+	vals := l.Values()
+	keep := make([]string, 0, len(vals))
+	removed := 0
+
+	if count < 0 {
+		for i := len(vals) - 1; i >= 0; i-- {
+			if vals[i] == v && removed < -count {
+				removed++
+				continue
+			}
+			keep = append(keep, vals[i])
+		}
+		for i, j := 0, len(keep)-1; i < j; i, j = i+1, j-1 {
+			keep[i], keep[j] = keep[j], keep[i]
+		}
+	} else {
+		for _, e := range vals {
+			if e == v && (count == 0 || removed < count) {
+				removed++
+				continue
+			}
+			keep = append(keep, e)
+		}
+	}
+
+	if removed > 0 {
+		l.reset(keep)
+	}
+	return removed
+}
+
+// Insert places v before or after the first occurrence of pivot and returns
+// the new length, or -1 when pivot is not in the list.
+func (l *List) Insert(before bool, pivot, v string) int {
+	vals := l.Values()
+	for i, e := range vals {
+		if e != pivot {
+			continue
+		}
+		if !before {
+			i++
+		}
+		vals = append(vals[:i], append([]string{v}, vals[i:]...)...)
+		l.reset(vals)
+		return l.n
+	}
+	return -1
+}
+
+func (l *List) memUsage() int64 {
+	stringHeader := 16
+	return int64(l.n*stringHeader) + l.size
+}
+
+func (l *List) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(l.Values())
+	return buf.Bytes(), err
+}
+
+func (l *List) GobDecode(data []byte) error {
+	var vals []string
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&vals); err != nil {
+		return err
+	}
+	l.reset(vals)
+	return nil
+}
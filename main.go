@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -11,6 +11,10 @@ import (
 var UNIX_TS_EPOCH int64 = -62135596800
 
 func main() {
+	truncateTo := flag.Int64("aof-truncate-to-timestamp", 0,
+		"restore the AOF to this unix time, discarding the writes logged after it")
+	flag.Parse()
+
 	log.Println("reading config file")
 	conf := readConf("./redis.conf")
 
@@ -25,18 +29,28 @@ func main() {
 		MaxCommandArgs = conf.maxCommandArgs
 	}
 
+	InitDatabases(conf.databases)
+	Notifications.flags = conf.notifyKeyspaceEvents
 	state := NewAppState(conf)
 
 	if conf.aofEnabled {
 		log.Println("syncing AOF records")
-		state.aof.Sync()
+		state.aof.Sync(*truncateTo)
+	} else if *truncateTo > 0 {
+		log.Println("aof-truncate-to-timestamp ignored, AOF is disabled")
 	}
 
+	// with AOF enabled the AOF alone holds the data, as in Redis: loading
+	// the RDB over it would bring back a state the AOF has moved past
 	if len(conf.rdb) > 0 {
-		SyncRDB(conf)
+		if !conf.aofEnabled {
+			SyncRDB(conf)
+		}
 		InitRDBTracker(state)
 	}
 
+	InitActiveExpire(state)
+
 	l, err := net.Listen("tcp", ":6379")
 	if err != nil {
 		log.Fatal(err)
@@ -62,10 +76,9 @@ func main() {
 func handleConn(conn net.Conn, state *AppState) {
 	log.Println("accepeted new connection: ", conn.LocalAddr().String())
 	c := NewClient(conn)
-	rd := bufio.NewReader(conn)
 	for {
 		r := Resp{sign: Array}
-		if err := r.parseRespArr(rd); err != nil {
+		if err := r.parseRespArr(c.rd); err != nil {
 			// ✅ Send protocol error
 			w := NewWrite(conn)
 			w.Write(&Resp{
@@ -87,6 +100,9 @@ func handleConn(conn net.Conn, state *AppState) {
 
 		handle(c, &r, state)
 	}
+	PubSub.unsubscribeAll(c)
+	c.unwatchAll()
+	c.stopPush()
 
 	log.Println("connection closed: ", conn.LocalAddr().String())
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The AOF is split into files kept in the appenddirname directory, laid
+// out as in Redis 7: an optional base file holding a snapshot written by
+// the last rewrite, and the incremental files logged since, in order. A
+// manifest names them, one line per file:
+//
+//	file backup.aof.2.base.rdb seq 2 type b
+//	file backup.aof.3.incr.aof seq 3 type i
+//
+// Records are only ever appended to the last incremental file. A rewrite
+// writes a new base next to the old files and then replaces the manifest,
+// so a crash at any point leaves a manifest describing a complete AOF.
+
+const (
+	aofBaseType = "b"
+	aofIncrType = "i"
+)
+
+type aofFile struct {
+	name string
+	seq  int
+	typ  string
+}
+
+type aofManifest struct {
+	base  *aofFile
+	incrs []aofFile
+}
+
+// files lists the manifest's files in the order they are replayed.
+func (m *aofManifest) files() []aofFile {
+	var files []aofFile
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// nextIncr names the incremental file that follows the manifest's last.
+func (m *aofManifest) nextIncr(fn string) aofFile {
+	seq := 1
+	if len(m.incrs) > 0 {
+		seq = m.incrs[len(m.incrs)-1].seq + 1
+	}
+	return aofFile{name: fmt.Sprintf("%s.%d.incr.aof", fn, seq), seq: seq, typ: aofIncrType}
+}
+
+// nextBase names the base file a rewrite of the manifest produces, ending
+// in .rdb when it is written with an RDB preamble.
+func (m *aofManifest) nextBase(fn string, preamble bool) aofFile {
+	seq := 1
+	if m.base != nil {
+		seq = m.base.seq + 1
+	}
+	ext := "aof"
+	if preamble {
+		ext = "rdb"
+	}
+	return aofFile{name: fmt.Sprintf("%s.%d.base.%s", fn, seq, ext), seq: seq, typ: aofBaseType}
+}
+
+func (m *aofManifest) encode() []byte {
+	var b bytes.Buffer
+	for _, f := range m.files() {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", f.name, f.seq, f.typ)
+	}
+	return b.Bytes()
+}
+
+func parseManifest(data []byte) (*aofManifest, error) {
+	m := &aofManifest{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("manifest line %d: odd number of fields", n)
+		}
+		var f aofFile
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[i+1])
+				if err != nil {
+					return nil, fmt.Errorf("manifest line %d: bad seq %q", n, fields[i+1])
+				}
+				f.seq = seq
+			case "type":
+				f.typ = fields[i+1]
+			}
+		}
+		if f.name == "" || strings.ContainsRune(f.name, '/') {
+			return nil, fmt.Errorf("manifest line %d: bad file name", n)
+		}
+
+		switch f.typ {
+		case aofBaseType:
+			if m.base != nil {
+				return nil, fmt.Errorf("manifest line %d: more than one base file", n)
+			}
+			m.base = &f
+		case aofIncrType:
+			m.incrs = append(m.incrs, f)
+		default:
+			return nil, fmt.Errorf("manifest line %d: unknown file type %q", n, f.typ)
+		}
+	}
+	return m, s.Err()
+}
+
+func manifestName(fn string) string {
+	return fn + ".manifest"
+}
+
+// loadManifest reads the manifest in dir. It returns nil without an error
+// when there is none yet.
+func loadManifest(dir, fn string) (*aofManifest, error) {
+	data, err := os.ReadFile(path.Join(dir, manifestName(fn)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// writeManifest atomically replaces the manifest in dir: it is written to
+// a temporary file, synced, and renamed over the old one.
+func writeManifest(dir, fn string, m *aofManifest) error {
+	tmp := path.Join(dir, "temp-"+manifestName(fn))
+	if err := writeFileSync(tmp, m.encode()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(dir, manifestName(fn))); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeFileSync writes data to the file at fp and syncs it to disk.
+func writeFileSync(fp string, data []byte) error {
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs a directory, making the renames and creations in it
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
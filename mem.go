@@ -5,11 +5,11 @@ type sample struct {
 	v *Item
 }
 
-func sampleKeys(state *AppState) []sample {
+func sampleKeys(db *Database, state *AppState) []sample {
 	maxSamples := state.conf.memSamples
 	samples := make([]sample, 0, maxSamples)
 
-	for k, v := range DB.store {
+	for k, v := range db.store {
 		samples = append(samples, sample{
 			k: k,
 			v: v,
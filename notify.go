@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Keyspace notifications. Write paths report what they did to a key with
+// db.notify; when the event's class is enabled by notify-keyspace-events it
+// is published on the pub/sub channels
+//
+//	__keyspace@<db>__:<key>    message: the event name  (flag K)
+//	__keyevent@<db>__:<event>  message: the key name    (flag E)
+//
+// and handed to every Go listener registered with Notifications.Listen.
+
+// Notification classes, selected with the same flag letters as Redis.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g: DEL, EXPIRE, RENAME, ...
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZSet                 // z
+	notifyStream               // t
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyNew                  // n: a key was added to the keyspace
+
+	// A, the alias for every class except n
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet | notifyStream | notifyExpired | notifyEvicted
+)
+
+var notifyFlagClasses = map[rune]int{
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+	'g': notifyGeneric,
+	'$': notifyString,
+	'l': notifyList,
+	's': notifySet,
+	'h': notifyHash,
+	'z': notifyZSet,
+	't': notifyStream,
+	'x': notifyExpired,
+	'e': notifyEvicted,
+	'n': notifyNew,
+	'A': notifyAll,
+}
+
+// parseNotifyFlags turns a notify-keyspace-events value such as "KEA" into
+// a set of notify* bits.
+func parseNotifyFlags(s string) (int, error) {
+	flags := 0
+	for _, c := range s {
+		class, ok := notifyFlagClasses[c]
+		if !ok {
+			return 0, fmt.Errorf("unknown notify-keyspace-events flag %q", c)
+		}
+		flags |= class
+	}
+	return flags, nil
+}
+
+// KeyspaceEvent is a notification as delivered to Go listeners.
+type KeyspaceEvent struct {
+	DB    int
+	Event string
+	Key   string
+}
+
+type Notifier struct {
+	flags int // set from the config at startup
+
+	mu        sync.RWMutex
+	listeners map[chan KeyspaceEvent]struct{}
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{listeners: map[chan KeyspaceEvent]struct{}{}}
+}
+
+var Notifications = NewNotifier()
+
+// Listen registers a Go listener for every event whose class is enabled,
+// whether or not K or E are set. Events are sent without blocking, so they
+// are dropped while the channel's buffer of size buf is full. The returned
+// function unregisters the listener and closes the channel.
+func (n *Notifier) Listen(buf int) (<-chan KeyspaceEvent, func()) {
+	ch := make(chan KeyspaceEvent, buf)
+	n.mu.Lock()
+	n.listeners[ch] = struct{}{}
+	n.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			n.mu.Lock()
+			delete(n.listeners, ch)
+			n.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (n *Notifier) notify(class int, event, key string, dbid int) {
+	if n.flags&class == 0 {
+		return
+	}
+
+	db := strconv.Itoa(dbid)
+	if n.flags&notifyKeyspace != 0 {
+		PubSub.publish("__keyspace@"+db+"__:"+key, event)
+	}
+	if n.flags&notifyKeyevent != 0 {
+		PubSub.publish("__keyevent@"+db+"__:"+event, key)
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for ch := range n.listeners {
+		select {
+		case ch <- KeyspaceEvent{DB: dbid, Event: event, Key: key}:
+		default:
+		}
+	}
+}
+
+// notify reports event of the given class against key k in db. Every
+// modification is reported here, so it also invalidates WATCHes on k.
+func (db *Database) notify(class int, event, k string) {
+	db.touch(k)
+	Notifications.notify(class, event, k, db.id)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// Pub/sub. The broker maps channels and patterns to their subscribers.
+// Once a client subscribes, everything sent to it, replies included, goes
+// through a bounded queue drained by a writer goroutine, so a message can
+// never overtake the reply that subscribed to it and PUBLISH never waits on
+// a subscriber's socket. A subscriber that lets its queue fill up is
+// disconnected, as Redis does when the pubsub output buffer limit is hit.
+
+// pubsubQueueLen is how many undelivered replies and messages a subscriber
+// may have queued before it is disconnected.
+const pubsubQueueLen = 1024
+
+type Broker struct {
+	mu       sync.RWMutex
+	channels map[string]map[*Client]struct{}
+	patterns map[string]map[*Client]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		channels: map[string]map[*Client]struct{}{},
+		patterns: map[string]map[*Client]struct{}{},
+	}
+}
+
+var PubSub = NewBroker()
+
+// subscribeCmds change a client's subscriptions. They cannot be queued in
+// a transaction.
+var subscribeCmds = []string{"SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE"}
+
+// subModeCmds are the commands a client in subscriber mode may still run.
+var subModeCmds = append([]string{"PING"}, subscribeCmds...)
+
+func subscriptionReply(kind, name string, count int) *Resp {
+	return &Resp{sign: Array, arr: []Resp{
+		{sign: BulkString, bulk: kind},
+		{sign: BulkString, bulk: name},
+		{sign: Integer, num: count},
+	}}
+}
+
+// subscribe adds c to each channel, or pattern when pattern is set, and
+// queues a confirmation per name.
+func (b *Broker) subscribe(c *Client, names []string, pattern bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c.startPush()
+	index, subs, kind := b.channels, c.channels, "subscribe"
+	if pattern {
+		index, subs, kind = b.patterns, c.patterns, "psubscribe"
+	}
+	for _, name := range names {
+		if !subs[name] {
+			subs[name] = true
+			if index[name] == nil {
+				index[name] = map[*Client]struct{}{}
+			}
+			index[name][c] = struct{}{}
+		}
+		c.deliver(subscriptionReply(kind, name, c.subscriptions()))
+	}
+}
+
+// unsubscribe removes c from the given channels or patterns, or from all
+// of them when names is empty, and queues a confirmation per name.
+func (b *Broker) unsubscribe(c *Client, names []string, pattern bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c.startPush()
+	index, subs, kind := b.channels, c.channels, "unsubscribe"
+	if pattern {
+		index, subs, kind = b.patterns, c.patterns, "punsubscribe"
+	}
+	if len(names) == 0 {
+		for name := range subs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		c.deliver(&Resp{sign: Array, arr: []Resp{
+			{sign: BulkString, bulk: kind},
+			{sign: Null},
+			{sign: Integer, num: c.subscriptions()},
+		}})
+		return
+	}
+
+	for _, name := range names {
+		if subs[name] {
+			delete(subs, name)
+			delete(index[name], c)
+			if len(index[name]) == 0 {
+				delete(index, name)
+			}
+		}
+		c.deliver(subscriptionReply(kind, name, c.subscriptions()))
+	}
+}
+
+// unsubscribeAll drops every subscription of a disconnecting client.
+func (b *Broker) unsubscribeAll(c *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name := range c.channels {
+		delete(b.channels[name], c)
+		if len(b.channels[name]) == 0 {
+			delete(b.channels, name)
+		}
+	}
+	for name := range c.patterns {
+		delete(b.patterns[name], c)
+		if len(b.patterns[name]) == 0 {
+			delete(b.patterns, name)
+		}
+	}
+	clear(c.channels)
+	clear(c.patterns)
+}
+
+// publish queues msg for every client subscribed to channel or to a
+// matching pattern, and returns how many deliveries were made.
+func (b *Broker) publish(channel, msg string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	n := 0
+	for c := range b.channels[channel] {
+		c.deliver(cmdResp("message", channel, msg))
+		n++
+	}
+	for pattern, subs := range b.patterns {
+		if !matchKey(pattern, channel) {
+			continue
+		}
+		for c := range subs {
+			c.deliver(cmdResp("pmessage", pattern, channel, msg))
+			n++
+		}
+	}
+	return n
+}
+
+// activeChannels returns the channels with at least one subscriber that
+// match pattern, or all of them when pattern is empty.
+func (b *Broker) activeChannels(pattern string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var names []string
+	for name := range b.channels {
+		if pattern == "" || matchKey(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *Broker) numSub(channel string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.channels[channel])
+}
+
+func (b *Broker) numPat() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.patterns)
+}
+
+// subscriptions counts the channels and patterns c is subscribed to. A
+// client with any subscription is in subscriber mode.
+func (c *Client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// startPush switches c over to queued delivery. It stays that way for the
+// rest of the connection, so replies and messages keep their order.
+func (c *Client) startPush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.out != nil || c.conn == nil {
+		return
+	}
+
+	out := make(chan *Resp, pubsubQueueLen)
+	c.out = out
+	go func() {
+		w := NewWrite(c.conn)
+		for r := range out {
+			w.Write(r)
+			if len(out) == 0 {
+				w.Flush()
+			}
+		}
+	}()
+}
+
+// stopPush shuts down the writer goroutine of a disconnecting client.
+func (c *Client) stopPush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.out != nil {
+		close(c.out)
+		c.out = nil
+	}
+}
+
+// pushing reports whether replies to c go through its queue.
+func (c *Client) pushing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out != nil
+}
+
+// deliver queues r for c without blocking. A client whose queue is full is
+// too slow to keep up and is disconnected.
+func (c *Client) deliver(r *Resp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.out == nil {
+		return
+	}
+
+	select {
+	case c.out <- r:
+	default:
+		log.Println("closing slow pubsub client:", c.conn.RemoteAddr())
+		close(c.out)
+		c.out = nil
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// radixTree is an ordered index of the keyspace. Each edge carries a run
+// of key bytes and children are kept sorted, so an in-order walk yields
+// keys lexicographically and all keys sharing a prefix live in a single
+// subtree. KEYS and KEYSPREFIX use it to skip keys that cannot match.
+type radixTree struct {
+	root *radixNode
+	n    int
+}
+
+type radixNode struct {
+	label    string // bytes on the edge leading to this node
+	children []*radixNode
+	leaf     bool // a key ends at this node
+}
+
+func newRadixTree() *radixTree {
+	return &radixTree{root: &radixNode{}}
+}
+
+func (t *radixTree) Len() int {
+	return t.n
+}
+
+func commonPrefixLen(a, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// child returns the index of the child whose label starts with byte c, or
+// the index it would be inserted at and false.
+func (n *radixNode) child(c byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].label[0] >= c })
+	return i, i < len(n.children) && n.children[i].label[0] == c
+}
+
+// insert adds k and reports whether it was not in the tree yet.
+func (t *radixTree) insert(k string) bool {
+	n := t.root
+	for {
+		if k == "" {
+			if n.leaf {
+				return false
+			}
+			n.leaf = true
+			t.n++
+			return true
+		}
+
+		i, ok := n.child(k[0])
+		if !ok {
+			leaf := &radixNode{label: k, leaf: true}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = leaf
+			t.n++
+			return true
+		}
+
+		c := n.children[i]
+		common := commonPrefixLen(k, c.label)
+		if common < len(c.label) {
+			// split the edge at the point where k diverges
+			split := &radixNode{label: c.label[:common], children: []*radixNode{c}}
+			c.label = c.label[common:]
+			n.children[i] = split
+			c = split
+		}
+		n = c
+		k = k[common:]
+	}
+}
+
+// delete removes k and reports whether it was in the tree. Nodes left
+// without a key or children are pruned, and a node left with a single
+// child is merged into it, so the tree stays compressed.
+func (t *radixTree) delete(k string) bool {
+	var parents []*radixNode
+	var idx []int
+	n := t.root
+	for k != "" {
+		i, ok := n.child(k[0])
+		if !ok || !strings.HasPrefix(k, n.children[i].label) {
+			return false
+		}
+		parents = append(parents, n)
+		idx = append(idx, i)
+		k = k[len(n.children[i].label):]
+		n = n.children[i]
+	}
+	if !n.leaf {
+		return false
+	}
+	n.leaf = false
+	t.n--
+
+	if len(parents) == 0 {
+		return true // the empty key lives at the root
+	}
+	parent, i := parents[len(parents)-1], idx[len(idx)-1]
+	switch len(n.children) {
+	case 0:
+		parent.children = append(parent.children[:i], parent.children[i+1:]...)
+		// the parent may now be a keyless pass-through node
+		if len(parents) > 1 && !parent.leaf && len(parent.children) == 1 {
+			grand, j := parents[len(parents)-2], idx[len(idx)-2]
+			only := parent.children[0]
+			only.label = parent.label + only.label
+			grand.children[j] = only
+		}
+	case 1:
+		only := n.children[0]
+		only.label = n.label + only.label
+		parent.children[i] = only
+	}
+	return true
+}
+
+// walkPrefix calls fn for every key starting with prefix that sorts after
+// the key after, in lexicographic order, until fn returns false. An empty
+// after visits the whole subtree.
+func (t *radixTree) walkPrefix(prefix, after string, fn func(k string) bool) {
+	n := t.root
+	path := ""
+	rest := prefix
+	for rest != "" {
+		i, ok := n.child(rest[0])
+		if !ok {
+			return
+		}
+		c := n.children[i]
+		common := commonPrefixLen(rest, c.label)
+		if common < len(rest) && common < len(c.label) {
+			return // diverges inside the edge
+		}
+		path += c.label
+		rest = rest[common:]
+		n = c
+	}
+	walkNode(n, path, after, fn)
+}
+
+// walkNode visits the subtree under n, whose keys all start with path.
+// Subtrees that sort entirely before after are skipped without being
+// visited. It returns false once fn has asked to stop.
+func walkNode(n *radixNode, path string, after string, fn func(k string) bool) bool {
+	// once the path sorts past after, so does everything below it
+	if after != "" && path > after {
+		after = ""
+	}
+	if n.leaf && after == "" {
+		if !fn(path) {
+			return false
+		}
+	}
+	for _, c := range n.children {
+		cp := path + c.label
+		if after != "" && cp < after && !strings.HasPrefix(after, cp) {
+			continue
+		}
+		if !walkNode(c, cp, after, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// globPrefix returns the literal part of a glob pattern before its first
+// special character. Every key matching the pattern starts with it.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
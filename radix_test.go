@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// walkAll collects the keys walkPrefix visits.
+func walkAll(t *radixTree, prefix, after string) []string {
+	var keys []string
+	t.walkPrefix(prefix, after, func(k string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// expectPrefix is walkPrefix worked out on a sorted slice.
+func expectPrefix(sorted []string, prefix, after string) []string {
+	var keys []string
+	for _, k := range sorted {
+		if strings.HasPrefix(k, prefix) && (after == "" || k > after) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRadixInsert(t *testing.T) {
+	tree := newRadixTree()
+	// splits an edge, extends one, and ends a key on an inner node
+	for _, k := range []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus", "rom", ""} {
+		if !tree.insert(k) {
+			t.Fatalf("insert(%q) = false for a new key", k)
+		}
+	}
+	if tree.insert("romanus") || tree.insert("rom") || tree.insert("") {
+		t.Fatal("insert of an existing key returned true")
+	}
+	if tree.Len() != 9 {
+		t.Fatalf("Len() = %d, want 9", tree.Len())
+	}
+
+	want := []string{"", "rom", "romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus"}
+	if got := walkAll(tree, "", ""); !slices.Equal(got, want) {
+		t.Fatalf("walk = %q, want %q", got, want)
+	}
+}
+
+func TestRadixDelete(t *testing.T) {
+	tree := newRadixTree()
+	for _, k := range []string{"a", "ab", "abc", "abd", "b", ""} {
+		tree.insert(k)
+	}
+
+	for _, tc := range []struct {
+		k    string
+		ok   bool
+		want []string
+	}{
+		{"abx", false, []string{"", "a", "ab", "abc", "abd", "b"}},
+		{"ab", true, []string{"", "a", "abc", "abd", "b"}},
+		{"ab", false, []string{"", "a", "abc", "abd", "b"}},
+		{"abc", true, []string{"", "a", "abd", "b"}}, // leaves a pass-through node to merge
+		{"", true, []string{"a", "abd", "b"}},
+		{"a", true, []string{"abd", "b"}},
+		{"abd", true, []string{"b"}},
+		{"b", true, nil},
+	} {
+		if ok := tree.delete(tc.k); ok != tc.ok {
+			t.Fatalf("delete(%q) = %v, want %v", tc.k, ok, tc.ok)
+		}
+		if got := walkAll(tree, "", ""); !slices.Equal(got, tc.want) {
+			t.Fatalf("after delete(%q) walk = %q, want %q", tc.k, got, tc.want)
+		}
+		if tree.Len() != len(tc.want) {
+			t.Fatalf("after delete(%q) Len() = %d, want %d", tc.k, tree.Len(), len(tc.want))
+		}
+	}
+	if len(tree.root.children) != 0 {
+		t.Fatalf("empty tree keeps %d children", len(tree.root.children))
+	}
+}
+
+// TestRadixRandom checks insert, delete and prefix walks against a sorted
+// reference on keys drawn from a small alphabet, so they share prefixes.
+func TestRadixRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randKey := func() string {
+		b := make([]byte, rng.Intn(8))
+		for i := range b {
+			b[i] = "abc:"[rng.Intn(4)]
+		}
+		return string(b)
+	}
+
+	tree := newRadixTree()
+	ref := map[string]bool{}
+	for i := 0; i < 20000; i++ {
+		k := randKey()
+		if rng.Intn(3) == 0 {
+			if got := tree.delete(k); got != ref[k] {
+				t.Fatalf("delete(%q) = %v, want %v", k, got, ref[k])
+			}
+			delete(ref, k)
+		} else {
+			if got := tree.insert(k); got == ref[k] {
+				t.Fatalf("insert(%q) = %v, want %v", k, got, !ref[k])
+			}
+			ref[k] = true
+		}
+
+		if i%500 != 0 {
+			continue
+		}
+		sorted := sortedKeys(ref)
+		if tree.Len() != len(sorted) {
+			t.Fatalf("Len() = %d, want %d", tree.Len(), len(sorted))
+		}
+		for j := 0; j < 20; j++ {
+			prefix, after := randKey(), ""
+			prefix = prefix[:min(len(prefix), rng.Intn(3))]
+			if rng.Intn(2) == 0 {
+				after = randKey()
+			}
+			want := expectPrefix(sorted, prefix, after)
+			if got := walkAll(tree, prefix, after); !slices.Equal(got, want) {
+				t.Fatalf("walkPrefix(%q, %q) = %q, want %q", prefix, after, got, want)
+			}
+		}
+	}
+}
+
+func TestRadixWalkStops(t *testing.T) {
+	tree := newRadixTree()
+	for i := 0; i < 100; i++ {
+		tree.insert(fmt.Sprintf("k%03d", i))
+	}
+	var got []string
+	tree.walkPrefix("k0", "k012", func(k string) bool {
+		got = append(got, k)
+		return len(got) < 3
+	})
+	if want := []string{"k013", "k014", "k015"}; !slices.Equal(got, want) {
+		t.Fatalf("walk = %q, want %q", got, want)
+	}
+}
+
+func TestGlobPrefix(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"user:42:*": "user:42:",
+		"user:4?":   "user:4",
+		"us[ae]r":   "us",
+		`a\*b`:      "a",
+		"*":         "",
+		"plain":     "plain",
+	} {
+		if got := globPrefix(pattern); got != want {
+			t.Errorf("globPrefix(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+const (
+	benchUsers  = 100_000
+	benchFields = 12 // benchUsers * benchFields keys, 1.2M
+)
+
+var benchKeysOnce sync.Once
+
+// benchKeys fills database 0 with user:<id>:f<n> keys, once per run.
+func benchKeys(b *testing.B) (*Client, *AppState) {
+	benchKeysOnce.Do(func() {
+		InitDatabases(1)
+		db := DBs[0]
+		for u := 0; u < benchUsers; u++ {
+			for f := 0; f < benchFields; f++ {
+				db.Put(fmt.Sprintf("user:%d:f%d", u, f), &Item{V: "v"})
+			}
+		}
+	})
+	b.ResetTimer()
+	return NewClient(nil), &AppState{conf: &Config{}}
+}
+
+func BenchmarkKeysPrefix(b *testing.B) {
+	c, state := benchKeys(b)
+	r := cmdResp("KEYSPREFIX", "user:4242:")
+	for i := 0; i < b.N; i++ {
+		if reply := keysprefix(c, r, state); len(reply.arr) != benchFields {
+			b.Fatalf("KEYSPREFIX returned %d keys, want %d", len(reply.arr), benchFields)
+		}
+	}
+}
+
+func BenchmarkKeysGlob(b *testing.B) {
+	c, state := benchKeys(b)
+	for _, bc := range []struct {
+		name, pattern string
+		want          int
+	}{
+		// the literal prefix confines the walk to one user's subtree
+		{"prefixed", "user:4242:*", benchFields},
+		// no literal prefix, so every key is matched against the pattern
+		{"unanchored", "*:4242:*", benchFields},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			r := cmdResp("KEYS", bc.pattern)
+			for i := 0; i < b.N; i++ {
+				if reply := keys(c, r, state); len(reply.arr) != bc.want {
+					b.Fatalf("KEYS %s returned %d keys, want %d", bc.pattern, len(reply.arr), bc.want)
+				}
+			}
+		})
+	}
+}
@@ -47,13 +47,29 @@ func InitRDBTracker(state *AppState) {
 	}
 }
 
+// IncrRDBTracker counts a change to the dataset towards the save points,
+// and marks the running write command to be logged, see propagation.
 func IncrRDBTracker() {
 	for _, t := range trackers {
 		t.keys++
 	}
+	prop.changed()
 }
 
+// SaveRDB writes the live databases to the RDB file, holding every
+// database's read lock meanwhile.
 func SaveRDB(state *AppState) {
+	unlock := rlockDBs()
+	defer unlock()
+	stores := make([]map[string]*Item, len(DBs))
+	for i, db := range DBs {
+		stores[i] = db.store
+	}
+	saveRDB(state, stores)
+}
+
+// saveRDB writes stores to the RDB file and verifies its checksum.
+func saveRDB(state *AppState, stores []map[string]*Item) {
 	fp := path.Join(state.conf.dir, state.conf.rdbFn)
 	f, err := os.OpenFile(fp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644) // owner (read-write), everyone (read)
 	if err != nil {
@@ -64,15 +80,7 @@ func SaveRDB(state *AppState) {
 
 	log.Println("saving DB to RDB file")
 	var buf bytes.Buffer
-	if state.bgsaveRunning {
-		err = gob.NewEncoder(&buf).Encode(&state.dbCopy)
-	} else {
-		DB.mu.RLock()
-		err = gob.NewEncoder(&buf).Encode(&DB.store)
-		DB.mu.RUnlock()
-	}
-
-	if err != nil {
+	if err := encodeRDB(&buf, stores); err != nil {
 		log.Println("error encoding database: ", err)
 		return
 	}
@@ -121,12 +129,49 @@ func SyncRDB(conf *Config) {
 	}
 	defer f.Close()
 
-	err = gob.NewDecoder(f).Decode(&DB.store)
+	data, err := io.ReadAll(f)
 	if err != nil {
-		log.Println("error decoding rdb file: ", err)
+		log.Println("error reading rdb file: ", err)
 		return
 	}
 
+	// files written before multiple databases hold a single keyspace,
+	// which is loaded into db 0
+	var stores []map[string]*Item
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stores); err != nil {
+		var store map[string]*Item
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&store); err != nil {
+			log.Println("error decoding rdb file: ", err)
+			return
+		}
+		stores = []map[string]*Item{store}
+	}
+
+	loadStores(stores)
+}
+
+// encodeRDB writes the keyspaces of every database in the RDB format, as
+// SaveRDB and AOF rewrites with an RDB preamble do.
+func encodeRDB(w io.Writer, stores []map[string]*Item) error {
+	return gob.NewEncoder(w).Encode(&stores)
+}
+
+// loadStores installs keyspaces read from an RDB encoding as the contents
+// of the databases.
+func loadStores(stores []map[string]*Item) {
+	for i, store := range stores {
+		if i >= len(DBs) {
+			log.Printf("rdb file holds %d databases, only %d are configured", len(stores), len(DBs))
+			break
+		}
+		db := DBs[i]
+		db.mu.Lock()
+		if store != nil {
+			db.store = store
+		}
+		db.reindex()
+		db.mu.Unlock()
+	}
 }
 
 func Hash(r io.Reader) (string, error) {
@@ -113,3 +113,53 @@ func (r *Resp) parseBulkStr(reader *bufio.Reader) (Resp, error) {
 		bulk: bulk,
 	}, nil
 }
+
+// cmdResp builds a command array of bulk strings, as a client would send it.
+func cmdResp(args ...string) *Resp {
+	return arrResp(args)
+}
+
+func okResp() *Resp {
+	return &Resp{sign: SimpleString, str: "OK"}
+}
+
+func errResp(msg string) *Resp {
+	return &Resp{sign: Error, err: msg}
+}
+
+func intResp(n int) *Resp {
+	return &Resp{sign: Integer, num: n}
+}
+
+func bulkResp(s string) *Resp {
+	return &Resp{sign: BulkString, bulk: s}
+}
+
+func nullResp() *Resp {
+	return &Resp{sign: Null}
+}
+
+// arrResp builds an array reply of bulk strings.
+func arrResp(vals []string) *Resp {
+	r := &Resp{sign: Array, arr: make([]Resp, 0, len(vals))}
+	for _, v := range vals {
+		r.arr = append(r.arr, Resp{sign: BulkString, bulk: v})
+	}
+	return r
+}
+
+func argsErr(cmd string) *Resp {
+	return errResp("ERR invalid args for '" + cmd + "'")
+}
+
+func wrongTypeErr() *Resp {
+	return errResp("WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func notIntErr() *Resp {
+	return errResp("ERR value is not an integer or out of range")
+}
+
+func syntaxErr() *Resp {
+	return errResp("ERR syntax error")
+}
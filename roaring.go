@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// Roaring bitmaps store sets of uint32 values compactly. Values are split
+// on their high 16 bits into chunks of 65536, and each non-empty chunk
+// holds its low 16 bits in a container: a sorted array while it has at
+// most 4096 values, and a 65536-bit bitmap (8KB) once it is denser, which
+// is the point where the bitmap becomes the smaller of the two. Sparse ID
+// sets therefore cost about two bytes per value and dense ones about one
+// bit per value, instead of a bit for every possible offset.
+
+const (
+	roaringArrayMax    = 4096
+	roaringBitmapWords = 65536 / 64
+)
+
+type roaringContainer struct {
+	array  []uint16 // sorted values while the container is sparse
+	bitmap []uint64 // roaringBitmapWords words once it is dense
+	card   int
+}
+
+func (c *roaringContainer) contains(x uint16) bool {
+	if c.bitmap != nil {
+		return c.bitmap[x/64]&(1<<(x%64)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= x })
+	return i < len(c.array) && c.array[i] == x
+}
+
+// add sets x and reports whether it was unset.
+func (c *roaringContainer) add(x uint16) bool {
+	if c.bitmap != nil {
+		w, b := x/64, uint64(1)<<(x%64)
+		if c.bitmap[w]&b != 0 {
+			return false
+		}
+		c.bitmap[w] |= b
+		c.card++
+		return true
+	}
+
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= x })
+	if i < len(c.array) && c.array[i] == x {
+		return false
+	}
+	if len(c.array) == roaringArrayMax {
+		c.toBitmap()
+		return c.add(x)
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = x
+	c.card++
+	return true
+}
+
+// remove clears x and reports whether it was set.
+func (c *roaringContainer) remove(x uint16) bool {
+	if c.bitmap != nil {
+		w, b := x/64, uint64(1)<<(x%64)
+		if c.bitmap[w]&b == 0 {
+			return false
+		}
+		c.bitmap[w] &^= b
+		c.card--
+		if c.card <= roaringArrayMax {
+			c.toArray()
+		}
+		return true
+	}
+
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= x })
+	if i == len(c.array) || c.array[i] != x {
+		return false
+	}
+	c.array = append(c.array[:i], c.array[i+1:]...)
+	c.card--
+	return true
+}
+
+func (c *roaringContainer) toBitmap() {
+	c.bitmap = c.words()
+	c.array = nil
+}
+
+func (c *roaringContainer) toArray() {
+	arr := make([]uint16, 0, c.card)
+	c.each(func(x uint16) bool {
+		arr = append(arr, x)
+		return true
+	})
+	c.array, c.bitmap = arr, nil
+}
+
+// words returns the container as a bitmap, a copy when it already is one.
+func (c *roaringContainer) words() []uint64 {
+	w := make([]uint64, roaringBitmapWords)
+	if c.bitmap != nil {
+		copy(w, c.bitmap)
+		return w
+	}
+	for _, x := range c.array {
+		w[x/64] |= 1 << (x % 64)
+	}
+	return w
+}
+
+// each calls fn for every value in ascending order until it returns false,
+// and reports whether it got to the end.
+func (c *roaringContainer) each(fn func(x uint16) bool) bool {
+	if c.bitmap == nil {
+		for _, x := range c.array {
+			if !fn(x) {
+				return false
+			}
+		}
+		return true
+	}
+	for i, w := range c.bitmap {
+		for w != 0 {
+			t := bits.TrailingZeros64(w)
+			if !fn(uint16(i*64 + t)) {
+				return false
+			}
+			w &= w - 1
+		}
+	}
+	return true
+}
+
+// containerFromWords builds a container from bitmap words, choosing the
+// representation by cardinality. It returns nil for an empty result.
+func containerFromWords(w []uint64) *roaringContainer {
+	card := 0
+	for _, word := range w {
+		card += bits.OnesCount64(word)
+	}
+	if card == 0 {
+		return nil
+	}
+	c := &roaringContainer{bitmap: w, card: card}
+	if card <= roaringArrayMax {
+		c.toArray()
+	}
+	return c
+}
+
+// bitmapOp combines two containers word by word.
+func bitmapOp(a, b *roaringContainer, op func(x, y uint64) uint64) *roaringContainer {
+	w, bw := a.words(), b.words()
+	for i := range w {
+		w[i] = op(w[i], bw[i])
+	}
+	return containerFromWords(w)
+}
+
+func (c *roaringContainer) and(o *roaringContainer) *roaringContainer {
+	if c.bitmap != nil && o.bitmap != nil {
+		return bitmapOp(c, o, func(x, y uint64) uint64 { return x & y })
+	}
+	// filter the array side, which bounds the result
+	small, big := c, o
+	if small.bitmap != nil {
+		small, big = o, c
+	}
+	var arr []uint16
+	for _, x := range small.array {
+		if big.contains(x) {
+			arr = append(arr, x)
+		}
+	}
+	if len(arr) == 0 {
+		return nil
+	}
+	return &roaringContainer{array: arr, card: len(arr)}
+}
+
+func (c *roaringContainer) andNot(o *roaringContainer) *roaringContainer {
+	if c.bitmap != nil {
+		return bitmapOp(c, o, func(x, y uint64) uint64 { return x &^ y })
+	}
+	var arr []uint16
+	for _, x := range c.array {
+		if !o.contains(x) {
+			arr = append(arr, x)
+		}
+	}
+	if len(arr) == 0 {
+		return nil
+	}
+	return &roaringContainer{array: arr, card: len(arr)}
+}
+
+func (c *roaringContainer) or(o *roaringContainer) *roaringContainer {
+	if c.bitmap != nil || o.bitmap != nil || c.card+o.card > roaringArrayMax {
+		return bitmapOp(c, o, func(x, y uint64) uint64 { return x | y })
+	}
+	arr := make([]uint16, 0, c.card+o.card)
+	i, j := 0, 0
+	for i < len(c.array) || j < len(o.array) {
+		switch {
+		case j == len(o.array) || (i < len(c.array) && c.array[i] < o.array[j]):
+			arr = append(arr, c.array[i])
+			i++
+		case i == len(c.array) || o.array[j] < c.array[i]:
+			arr = append(arr, o.array[j])
+			j++
+		default:
+			arr = append(arr, c.array[i])
+			i++
+			j++
+		}
+	}
+	return &roaringContainer{array: arr, card: len(arr)}
+}
+
+func (c *roaringContainer) xor(o *roaringContainer) *roaringContainer {
+	if c.bitmap != nil || o.bitmap != nil || c.card+o.card > roaringArrayMax {
+		return bitmapOp(c, o, func(x, y uint64) uint64 { return x ^ y })
+	}
+	var arr []uint16
+	i, j := 0, 0
+	for i < len(c.array) || j < len(o.array) {
+		switch {
+		case j == len(o.array) || (i < len(c.array) && c.array[i] < o.array[j]):
+			arr = append(arr, c.array[i])
+			i++
+		case i == len(c.array) || o.array[j] < c.array[i]:
+			arr = append(arr, o.array[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	if len(arr) == 0 {
+		return nil
+	}
+	return &roaringContainer{array: arr, card: len(arr)}
+}
+
+func (c *roaringContainer) clone() *roaringContainer {
+	return &roaringContainer{
+		array:  append([]uint16(nil), c.array...),
+		bitmap: append([]uint64(nil), c.bitmap...),
+		card:   c.card,
+	}
+}
+
+// memUsage counts the container header plus its array or bitmap storage.
+func (c *roaringContainer) memUsage() int64 {
+	sliceHeader := 24
+	return int64(2*sliceHeader+8) + int64(2*cap(c.array)+8*cap(c.bitmap))
+}
+
+type RoaringBitmap struct {
+	keys       []uint16 // high 16 bits of each chunk, ascending
+	containers []*roaringContainer
+	card       int
+}
+
+func NewRoaringBitmap() *RoaringBitmap {
+	return &RoaringBitmap{}
+}
+
+func (rb *RoaringBitmap) Card() int {
+	return rb.card
+}
+
+// find returns the index of the chunk with high bits hi, or where it
+// would be inserted and false.
+func (rb *RoaringBitmap) find(hi uint16) (int, bool) {
+	i := sort.Search(len(rb.keys), func(i int) bool { return rb.keys[i] >= hi })
+	return i, i < len(rb.keys) && rb.keys[i] == hi
+}
+
+func (rb *RoaringBitmap) Contains(x uint32) bool {
+	i, ok := rb.find(uint16(x >> 16))
+	return ok && rb.containers[i].contains(uint16(x))
+}
+
+// Add sets x and reports whether it was unset.
+func (rb *RoaringBitmap) Add(x uint32) bool {
+	hi := uint16(x >> 16)
+	i, ok := rb.find(hi)
+	if !ok {
+		rb.keys = append(rb.keys, 0)
+		copy(rb.keys[i+1:], rb.keys[i:])
+		rb.keys[i] = hi
+		rb.containers = append(rb.containers, nil)
+		copy(rb.containers[i+1:], rb.containers[i:])
+		rb.containers[i] = &roaringContainer{}
+	}
+	if !rb.containers[i].add(uint16(x)) {
+		return false
+	}
+	rb.card++
+	return true
+}
+
+// Remove clears x and reports whether it was set.
+func (rb *RoaringBitmap) Remove(x uint32) bool {
+	i, ok := rb.find(uint16(x >> 16))
+	if !ok || !rb.containers[i].remove(uint16(x)) {
+		return false
+	}
+	rb.card--
+	if rb.containers[i].card == 0 {
+		rb.keys = append(rb.keys[:i], rb.keys[i+1:]...)
+		rb.containers = append(rb.containers[:i], rb.containers[i+1:]...)
+	}
+	return true
+}
+
+// Range calls fn for every value in [start, end] in ascending order until
+// it returns false.
+func (rb *RoaringBitmap) Range(start, end uint32, fn func(x uint32) bool) {
+	i, _ := rb.find(uint16(start >> 16))
+	for ; i < len(rb.keys); i++ {
+		base := uint32(rb.keys[i]) << 16
+		if base > end {
+			return
+		}
+		more := rb.containers[i].each(func(lo uint16) bool {
+			x := base | uint32(lo)
+			if x < start {
+				return true
+			}
+			if x > end {
+				return false
+			}
+			return fn(x)
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+func (rb *RoaringBitmap) appendContainer(hi uint16, c *roaringContainer) {
+	if c == nil {
+		return
+	}
+	rb.keys = append(rb.keys, hi)
+	rb.containers = append(rb.containers, c)
+	rb.card += c.card
+}
+
+// And returns the intersection of rb and o.
+func (rb *RoaringBitmap) And(o *RoaringBitmap) *RoaringBitmap {
+	out := NewRoaringBitmap()
+	for i, j := 0, 0; i < len(rb.keys) && j < len(o.keys); {
+		switch {
+		case rb.keys[i] < o.keys[j]:
+			i++
+		case rb.keys[i] > o.keys[j]:
+			j++
+		default:
+			out.appendContainer(rb.keys[i], rb.containers[i].and(o.containers[j]))
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// AndNot returns the values of rb that are not in o.
+func (rb *RoaringBitmap) AndNot(o *RoaringBitmap) *RoaringBitmap {
+	out := NewRoaringBitmap()
+	j := 0
+	for i, hi := range rb.keys {
+		for j < len(o.keys) && o.keys[j] < hi {
+			j++
+		}
+		if j < len(o.keys) && o.keys[j] == hi {
+			out.appendContainer(hi, rb.containers[i].andNot(o.containers[j]))
+		} else {
+			out.appendContainer(hi, rb.containers[i].clone())
+		}
+	}
+	return out
+}
+
+// Or returns the union of rb and o.
+func (rb *RoaringBitmap) Or(o *RoaringBitmap) *RoaringBitmap {
+	return rb.merge(o, (*roaringContainer).or)
+}
+
+// Xor returns the values in exactly one of rb and o.
+func (rb *RoaringBitmap) Xor(o *RoaringBitmap) *RoaringBitmap {
+	return rb.merge(o, (*roaringContainer).xor)
+}
+
+// merge walks both bitmaps, copying chunks present in only one and
+// combining the others with op.
+func (rb *RoaringBitmap) merge(o *RoaringBitmap, op func(a, b *roaringContainer) *roaringContainer) *RoaringBitmap {
+	out := NewRoaringBitmap()
+	i, j := 0, 0
+	for i < len(rb.keys) || j < len(o.keys) {
+		switch {
+		case j == len(o.keys) || (i < len(rb.keys) && rb.keys[i] < o.keys[j]):
+			out.appendContainer(rb.keys[i], rb.containers[i].clone())
+			i++
+		case i == len(rb.keys) || o.keys[j] < rb.keys[i]:
+			out.appendContainer(o.keys[j], o.containers[j].clone())
+			j++
+		default:
+			out.appendContainer(rb.keys[i], op(rb.containers[i], o.containers[j]))
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func (rb *RoaringBitmap) clone() *RoaringBitmap {
+	cp := &RoaringBitmap{keys: append([]uint16(nil), rb.keys...), card: rb.card}
+	for _, c := range rb.containers {
+		cp.containers = append(cp.containers, c.clone())
+	}
+	return cp
+}
+
+// memUsage is the bitmap header, its key and container slices, and every
+// container's storage.
+func (rb *RoaringBitmap) memUsage() int64 {
+	size := int64(2*24+8) + int64(2*cap(rb.keys)+8*cap(rb.containers))
+	for _, c := range rb.containers {
+		size += c.memUsage()
+	}
+	return size
+}
+
+// The serialised form is a container count followed, per container, by
+// its high bits, a kind byte and the container's cardinality, then the
+// sorted values of an array or the words of a bitmap, all little endian.
+const (
+	roaringArrayKind  = 0
+	roaringBitmapKind = 1
+)
+
+func (rb *RoaringBitmap) GobEncode() ([]byte, error) {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(rb.keys)))
+	for i, c := range rb.containers {
+		buf = binary.LittleEndian.AppendUint16(buf, rb.keys[i])
+		if c.bitmap != nil {
+			buf = append(buf, roaringBitmapKind)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(c.card))
+			for _, w := range c.bitmap {
+				buf = binary.LittleEndian.AppendUint64(buf, w)
+			}
+			continue
+		}
+		buf = append(buf, roaringArrayKind)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(c.card))
+		for _, x := range c.array {
+			buf = binary.LittleEndian.AppendUint16(buf, x)
+		}
+	}
+	return buf, nil
+}
+
+var errBadRoaring = errors.New("malformed roaring bitmap")
+
+func (rb *RoaringBitmap) GobDecode(data []byte) error {
+	*rb = RoaringBitmap{}
+	if len(data) < 4 {
+		return errBadRoaring
+	}
+	n := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for ; n > 0; n-- {
+		if len(data) < 7 {
+			return errBadRoaring
+		}
+		hi, kind, card := binary.LittleEndian.Uint16(data), data[2], int(binary.LittleEndian.Uint32(data[3:]))
+		data = data[7:]
+
+		c := &roaringContainer{card: card}
+		switch kind {
+		case roaringBitmapKind:
+			if len(data) < 8*roaringBitmapWords {
+				return errBadRoaring
+			}
+			c.bitmap = make([]uint64, roaringBitmapWords)
+			for i := range c.bitmap {
+				c.bitmap[i] = binary.LittleEndian.Uint64(data[8*i:])
+			}
+			data = data[8*roaringBitmapWords:]
+		case roaringArrayKind:
+			if card > roaringArrayMax || len(data) < 2*card {
+				return errBadRoaring
+			}
+			c.array = make([]uint16, card)
+			for i := range c.array {
+				c.array[i] = binary.LittleEndian.Uint16(data[2*i:])
+			}
+			data = data[2*card:]
+		default:
+			return errBadRoaring
+		}
+		rb.appendContainer(hi, c)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "hash/fnv"
+
+// SCAN walks the keyspace in the order of a 52-bit hash of each key, kept
+// in db.scanIdx. A cursor is the hash position to resume from, plus one so
+// that 0 can mean both "start" and "done". Positions do not move as keys
+// come and go, so every key present for the whole iteration is returned;
+// keys sharing a hash may be returned twice, which SCAN allows.
+
+// scanHash is exact as a float64, so it can be the skiplist score.
+func scanHash(k string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(k))
+	return float64(h.Sum64() >> 12)
+}
+
+// scan returns up to count keys from cursor onwards and the cursor to
+// continue from, which is 0 once the keyspace is exhausted. The caller
+// must hold db.mu.
+func (db *Database) scan(cursor uint64, count int) ([]string, uint64) {
+	var from float64
+	if cursor > 0 {
+		from = float64(cursor - 1)
+	}
+
+	x := db.scanIdx.firstMatch(func(n *zslNode) bool { return n.score >= from })
+	keys := make([]string, 0, count)
+	for ; x != nil && len(keys) < count; x = x.level[0].forward {
+		keys = append(keys, x.member)
+	}
+
+	if x == nil {
+		return keys, 0
+	}
+	return keys, uint64(x.score) + 1
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+)
+
+// HashSet is an unordered set of strings. Members are also kept in a dense
+// slice so random picks for SPOP and SRANDMEMBER are O(1).
+type HashSet struct {
+	idx     map[string]int
+	members []string
+	size    int64 // total bytes held by the members
+}
+
+func NewHashSet() *HashSet {
+	return &HashSet{idx: map[string]int{}}
+}
+
+func (s *HashSet) Len() int {
+	return len(s.members)
+}
+
+func (s *HashSet) Has(m string) bool {
+	_, ok := s.idx[m]
+	return ok
+}
+
+// Add inserts m and reports whether it was not already a member.
+func (s *HashSet) Add(m string) bool {
+	if s.Has(m) {
+		return false
+	}
+	s.idx[m] = len(s.members)
+	s.members = append(s.members, m)
+	s.size += int64(len(m))
+	return true
+}
+
+func (s *HashSet) Remove(m string) bool {
+	i, ok := s.idx[m]
+	if !ok {
+		return false
+	}
+	last := len(s.members) - 1
+	s.members[i] = s.members[last]
+	s.idx[s.members[i]] = i
+	s.members = s.members[:last]
+	delete(s.idx, m)
+	s.size -= int64(len(m))
+	return true
+}
+
+func (s *HashSet) Random() string {
+	return s.members[rand.Intn(len(s.members))]
+}
+
+func (s *HashSet) Members() []string {
+	return append([]string(nil), s.members...)
+}
+
+func (s *HashSet) memUsage() int64 {
+	stringHeader := 16
+	mapEntrySize := 32
+	return int64(len(s.members)*(2*stringHeader+mapEntrySize)) + s.size
+}
+
+func (s *HashSet) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(s.members)
+	return buf.Bytes(), err
+}
+
+func (s *HashSet) GobDecode(data []byte) error {
+	var members []string
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&members); err != nil {
+		return err
+	}
+	*s = *NewHashSet()
+	for _, m := range members {
+		s.Add(m)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import "sync/atomic"
+
+// Stats holds the server wide counters reported by INFO stats.
+type Stats struct {
+	expiredKeys           atomic.Int64
+	expiredStalePerc      atomic.Int64 // running average, in percent
+	expiredTimeCapReached atomic.Int64
+	expireCycleCount      atomic.Int64
+	expireCycleTime       atomic.Int64 // total microseconds spent in active expire cycles
+	evictedKeys           atomic.Int64
+}
+
+var ServerStats = &Stats{}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Streams are append-only logs of field/value entries keyed by IDs made of
+// a millisecond timestamp and a sequence number. Entries are kept in a
+// slice ordered by ID, so appends are cheap and ranges are found with a
+// binary search. Consumer groups track which entries they have handed out
+// and keep them in a pending entries list (PEL) until they are acked.
+
+type streamID struct {
+	ms, seq uint64
+}
+
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+// next returns the smallest ID after id, and false when id is the largest.
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the largest ID before id, and false when id is 0-0.
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+var errInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+// parseStreamID parses "ms-seq", or a bare "ms" whose sequence number is
+// taken to be missingSeq.
+func parseStreamID(s string, missingSeq uint64) (streamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	return streamID{ms, seq}, nil
+}
+
+// parseRangeID parses a bound of XRANGE and friends: "-", "+", an ID or an
+// incomplete ID, optionally prefixed with "(" to exclude it. start picks
+// which end of the range the bound is.
+func parseRangeID(s string, start bool) (streamID, error) {
+	switch s {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	missingSeq := uint64(0)
+	if !start {
+		missingSeq = math.MaxUint64
+	}
+	id, err := parseStreamID(s, missingSeq)
+	if err != nil || !exclusive {
+		return id, err
+	}
+
+	var ok bool
+	if start {
+		id, ok = id.next()
+	} else {
+		id, ok = id.prev()
+	}
+	if !ok {
+		return id, errors.New("ERR invalid start or end ID for the interval")
+	}
+	return id, nil
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string // field, value, field, value, ...
+}
+
+type pendingEntry struct {
+	id         streamID
+	consumer   string
+	delivered  time.Time // when it was last delivered
+	deliveries int
+}
+
+func (pe *pendingEntry) idle(now time.Time) int64 {
+	return max(now.Sub(pe.delivered).Milliseconds(), 0)
+}
+
+type streamGroup struct {
+	lastID    streamID // the last entry delivered to the group
+	pel       []*pendingEntry
+	pending   map[streamID]*pendingEntry
+	consumers map[string]struct{}
+	size      *int64 // the running total of the stream owning the group
+}
+
+// Sizes of the parts of a stream as memUsage accounts them.
+const (
+	streamEntrySize  = 16 + 24      // ID and fields slice
+	pendingEntrySize = 8 + 32 + 64  // PEL slot, map entry and the entry
+	streamGroupSize  = 32 + 16 + 64 // map entry, name header and the group
+	consumerSize     = 32 + 16      // map entry and name header
+)
+
+func fieldsSize(fields []string) int64 {
+	n := 0
+	for _, f := range fields {
+		n += 16 + len(f)
+	}
+	return int64(n)
+}
+
+// pelIndex returns the position of the first pending entry not before id.
+func (g *streamGroup) pelIndex(id streamID) int {
+	return sort.Search(len(g.pel), func(i int) bool { return !g.pel[i].id.less(id) })
+}
+
+// addPending adds or replaces the pending entry for pe.id. Entries handed
+// out by XREADGROUP arrive in ID order and are simply appended.
+func (g *streamGroup) addPending(pe *pendingEntry) {
+	if _, ok := g.pending[pe.id]; ok {
+		g.removePending(pe.id)
+	}
+	i := g.pelIndex(pe.id)
+	g.pel = append(g.pel, nil)
+	copy(g.pel[i+1:], g.pel[i:])
+	g.pel[i] = pe
+	g.pending[pe.id] = pe
+	*g.size += pendingEntrySize
+}
+
+func (g *streamGroup) removePending(id streamID) bool {
+	if _, ok := g.pending[id]; !ok {
+		return false
+	}
+	delete(g.pending, id)
+	i := g.pelIndex(id)
+	g.pel = append(g.pel[:i], g.pel[i+1:]...)
+	*g.size -= pendingEntrySize
+	return true
+}
+
+// addConsumer registers consumer and reports whether it is new.
+func (g *streamGroup) addConsumer(consumer string) bool {
+	if _, ok := g.consumers[consumer]; ok {
+		return false
+	}
+	g.consumers[consumer] = struct{}{}
+	*g.size += int64(consumerSize + len(consumer))
+	return true
+}
+
+// pendingOf counts the entries pending for consumer.
+func (g *streamGroup) pendingOf(consumer string) int {
+	n := 0
+	for _, pe := range g.pel {
+		if pe.consumer == consumer {
+			n++
+		}
+	}
+	return n
+}
+
+// deleteConsumer drops consumer and its pending entries, and returns how
+// many entries were pending.
+func (g *streamGroup) deleteConsumer(consumer string) int {
+	kept := g.pel[:0]
+	n := 0
+	for _, pe := range g.pel {
+		if pe.consumer == consumer {
+			delete(g.pending, pe.id)
+			n++
+			continue
+		}
+		kept = append(kept, pe)
+	}
+	g.pel = kept
+	*g.size -= int64(n * pendingEntrySize)
+	if _, ok := g.consumers[consumer]; ok {
+		delete(g.consumers, consumer)
+		*g.size -= int64(consumerSize + len(consumer))
+	}
+	return n
+}
+
+// Stream keeps a running total of its size, like HashMap, so memory
+// accounting stays O(1). Groups are added and removed through addGroup and
+// deleteGroup, which point them at that total.
+type Stream struct {
+	entries []streamEntry // ordered by ID
+	lastID  streamID      // the largest ID ever added, deleted or not
+	groups  map[string]*streamGroup
+	size    int64 // bytes held by fields, groups, consumers and PELs
+}
+
+func NewStream() *Stream {
+	return &Stream{groups: map[string]*streamGroup{}}
+}
+
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// addGroup creates the consumer group name, which must not exist yet.
+func (s *Stream) addGroup(name string, lastID streamID) *streamGroup {
+	g := &streamGroup{
+		lastID:    lastID,
+		pending:   map[streamID]*pendingEntry{},
+		consumers: map[string]struct{}{},
+		size:      &s.size,
+	}
+	s.groups[name] = g
+	s.size += int64(streamGroupSize + len(name))
+	return g
+}
+
+func (s *Stream) deleteGroup(name string) {
+	g, ok := s.groups[name]
+	if !ok {
+		return
+	}
+	delete(s.groups, name)
+	s.size -= int64(streamGroupSize + len(name) + len(g.pel)*pendingEntrySize)
+	for consumer := range g.consumers {
+		s.size -= int64(consumerSize + len(consumer))
+	}
+}
+
+// nextID generates the ID for XADD *, or for "ms-*" when ms is given.
+func (s *Stream) nextID(ms uint64, auto bool) (streamID, error) {
+	if auto {
+		ms = max(uint64(time.Now().UnixMilli()), s.lastID.ms)
+	}
+	if ms == s.lastID.ms {
+		if s.lastID.seq == math.MaxUint64 {
+			if !auto {
+				return streamID{}, errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+			}
+			return streamID{}, errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+		}
+		return streamID{ms, s.lastID.seq + 1}, nil
+	}
+	if ms < s.lastID.ms {
+		return streamID{}, errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	return streamID{ms, 0}, nil
+}
+
+// Add appends an entry. id must be larger than lastID.
+func (s *Stream) Add(id streamID, fields []string) {
+	s.entries = append(s.entries, streamEntry{id: id, fields: fields})
+	s.lastID = id
+	s.size += fieldsSize(fields)
+}
+
+// index returns the position of the first entry not before id.
+func (s *Stream) index(id streamID) int {
+	return sort.Search(len(s.entries), func(i int) bool { return !s.entries[i].id.less(id) })
+}
+
+func (s *Stream) Get(id streamID) (streamEntry, bool) {
+	i := s.index(id)
+	if i < len(s.entries) && s.entries[i].id == id {
+		return s.entries[i], true
+	}
+	return streamEntry{}, false
+}
+
+// Range returns up to count entries with IDs in [start, end], newest first
+// when rev is set. A count of zero or less means no limit.
+func (s *Stream) Range(start, end streamID, rev bool, count int) []streamEntry {
+	if end.less(start) {
+		return nil
+	}
+	lo, hi := s.index(start), s.index(end)
+	if hi < len(s.entries) && s.entries[hi].id == end {
+		hi++
+	}
+	var out []streamEntry
+	for n := 0; n < hi-lo && (count <= 0 || n < count); n++ {
+		i := lo + n
+		if rev {
+			i = hi - 1 - n
+		}
+		out = append(out, s.entries[i])
+	}
+	return out
+}
+
+// After returns up to count entries with IDs larger than id.
+func (s *Stream) After(id streamID, count int) []streamEntry {
+	start, ok := id.next()
+	if !ok {
+		return nil
+	}
+	return s.Range(start, maxStreamID, false, count)
+}
+
+// Delete removes the entries with the given IDs and returns how many
+// existed. Pending entries referring to them are left alone, as in Redis.
+func (s *Stream) Delete(ids []streamID) int {
+	n := 0
+	for _, id := range ids {
+		i := s.index(id)
+		if i < len(s.entries) && s.entries[i].id == id {
+			s.size -= fieldsSize(s.entries[i].fields)
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			n++
+		}
+	}
+	return n
+}
+
+// streamTrim is a MAXLEN or MINID trimming request of XADD and XTRIM.
+type streamTrim struct {
+	minID  bool // MINID rather than MAXLEN
+	maxLen int
+	id     streamID
+	limit  int // at most this many entries are evicted, 0 for no limit
+}
+
+// Trim evicts the oldest entries until the stream satisfies t, and returns
+// how many were evicted. Approximate trimming (~) is done exactly, which
+// Redis allows.
+func (s *Stream) Trim(t streamTrim) int {
+	n := 0
+	if t.minID {
+		n = s.index(t.id)
+	} else if len(s.entries) > t.maxLen {
+		n = len(s.entries) - t.maxLen
+	}
+	if t.limit > 0 {
+		n = min(n, t.limit)
+	}
+	if n > 0 {
+		for _, e := range s.entries[:n] {
+			s.size -= fieldsSize(e.fields)
+		}
+		s.entries = append([]streamEntry(nil), s.entries[n:]...)
+	}
+	return n
+}
+
+func (s *Stream) clone() *Stream {
+	cp := NewStream()
+	cp.entries = append([]streamEntry(nil), s.entries...)
+	cp.lastID = s.lastID
+	for name, g := range s.groups {
+		cg := cp.addGroup(name, g.lastID)
+		for _, pe := range g.pel {
+			c := *pe
+			cg.addPending(&c)
+		}
+		for consumer := range g.consumers {
+			cg.addConsumer(consumer)
+		}
+	}
+	cp.size = s.size
+	return cp
+}
+
+func (s *Stream) memUsage() int64 {
+	return int64(len(s.entries)*streamEntrySize) + s.size
+}
+
+// streamGob is the serialised form of a stream, with its groups' pending
+// entries and consumers.
+type streamGob struct {
+	IDs    [][2]uint64
+	Fields [][]string
+	LastID [2]uint64
+	Groups []streamGroupGob
+}
+
+type streamGroupGob struct {
+	Name      string
+	LastID    [2]uint64
+	Consumers []string
+	Pending   []pendingGob
+}
+
+type pendingGob struct {
+	ID         [2]uint64
+	Consumer   string
+	Delivered  int64 // Unix milliseconds
+	Deliveries int
+}
+
+func (s *Stream) GobEncode() ([]byte, error) {
+	g := streamGob{LastID: [2]uint64{s.lastID.ms, s.lastID.seq}}
+	for _, e := range s.entries {
+		g.IDs = append(g.IDs, [2]uint64{e.id.ms, e.id.seq})
+		g.Fields = append(g.Fields, e.fields)
+	}
+	for name, grp := range s.groups {
+		gg := streamGroupGob{Name: name, LastID: [2]uint64{grp.lastID.ms, grp.lastID.seq}}
+		for consumer := range grp.consumers {
+			gg.Consumers = append(gg.Consumers, consumer)
+		}
+		for _, pe := range grp.pel {
+			gg.Pending = append(gg.Pending, pendingGob{
+				ID:         [2]uint64{pe.id.ms, pe.id.seq},
+				Consumer:   pe.consumer,
+				Delivered:  pe.delivered.UnixMilli(),
+				Deliveries: pe.deliveries,
+			})
+		}
+		g.Groups = append(g.Groups, gg)
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(g)
+	return buf.Bytes(), err
+}
+
+func (s *Stream) GobDecode(data []byte) error {
+	var g streamGob
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	*s = *NewStream()
+	for i, id := range g.IDs {
+		s.Add(streamID{id[0], id[1]}, g.Fields[i])
+	}
+	s.lastID = streamID{g.LastID[0], g.LastID[1]}
+	for _, gg := range g.Groups {
+		grp := s.addGroup(gg.Name, streamID{gg.LastID[0], gg.LastID[1]})
+		for _, consumer := range gg.Consumers {
+			grp.addConsumer(consumer)
+		}
+		for _, p := range gg.Pending {
+			grp.addPending(&pendingEntry{
+				id:         streamID{p.ID[0], p.ID[1]},
+				consumer:   p.Consumer,
+				delivered:  time.UnixMilli(p.Delivered),
+				deliveries: p.Deliveries,
+			})
+		}
+	}
+	return nil
+}
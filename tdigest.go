@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"sort"
+)
+
+// T-digests estimate quantiles of a stream of values in bounded memory.
+// This is Dunning's merging digest, the variant RedisBloom implements: new
+// values are buffered and periodically merged with the sorted centroids,
+// and the k1 scale function decides how much weight a centroid may absorb.
+// Centroids near the tails stay small, so extreme quantiles such as p99.9
+// remain accurate while the middle of the distribution is summarised
+// coarsely. Higher compression keeps more centroids and is more accurate.
+
+const defaultTDigestCompression = 100
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+type TDigest struct {
+	compression float64
+	merged      []centroid // sorted by mean
+	unmerged    []centroid // added since the last compress
+	mergedW     float64
+	unmergedW   float64
+	min, max    float64
+
+	compressions int
+}
+
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// capacity is how many centroids plus buffered values the digest holds
+// before it compresses, the same sizing RedisBloom uses.
+func (t *TDigest) capacity() int {
+	return 6*int(math.Ceil(t.compression)) + 10
+}
+
+func (t *TDigest) Count() float64 {
+	return t.mergedW + t.unmergedW
+}
+
+func (t *TDigest) Add(v float64) {
+	t.addWeighted(v, 1)
+}
+
+func (t *TDigest) addWeighted(v, w float64) {
+	if len(t.merged)+len(t.unmerged) >= t.capacity() {
+		t.compress()
+	}
+	t.unmerged = append(t.unmerged, centroid{v, w})
+	t.unmergedW += w
+	t.min = math.Min(t.min, v)
+	t.max = math.Max(t.max, v)
+}
+
+// Merge adds every centroid of o to t.
+func (t *TDigest) Merge(o *TDigest) {
+	for _, c := range o.merged {
+		t.addWeighted(c.mean, c.weight)
+	}
+	for _, c := range o.unmerged {
+		t.addWeighted(c.mean, c.weight)
+	}
+	if o.Count() > 0 {
+		t.min = math.Min(t.min, o.min)
+		t.max = math.Max(t.max, o.max)
+	}
+}
+
+func (t *TDigest) Reset() {
+	*t = *NewTDigest(t.compression)
+}
+
+// scale is the k1 scale function, mapping a quantile to its index in
+// centroid space; scaleInv is its inverse.
+func (t *TDigest) scale(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (t *TDigest) scaleInv(k float64) float64 {
+	return (math.Sin(k*2*math.Pi/t.compression) + 1) / 2
+}
+
+// compress folds the buffered values into the centroids. Neighbouring
+// centroids are combined while the result spans at most one unit of the
+// scale function.
+func (t *TDigest) compress() {
+	if len(t.unmerged) == 0 {
+		return
+	}
+	all := append(t.merged, t.unmerged...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	total := t.Count()
+	out := make([]centroid, 0, len(all))
+	cur := all[0]
+	soFar := 0.0
+	limit := total * t.scaleInv(t.scale(0)+1)
+	for _, c := range all[1:] {
+		if soFar+cur.weight+c.weight <= limit {
+			// weighted mean, written to avoid drifting on equal means
+			cur.weight += c.weight
+			cur.mean += (c.mean - cur.mean) * c.weight / cur.weight
+			continue
+		}
+		out = append(out, cur)
+		soFar += cur.weight
+		limit = total * t.scaleInv(t.scale(soFar/total)+1)
+		cur = c
+	}
+	out = append(out, cur)
+
+	t.merged = out
+	t.unmerged = nil
+	t.mergedW = total
+	t.unmergedW = 0
+	t.compressions++
+}
+
+// weightedAverage interpolates between x1 and x2, keeping the result
+// between them despite rounding.
+func weightedAverage(x1, w1, x2, w2 float64) float64 {
+	if x1 > x2 {
+		x1, w1, x2, w2 = x2, w2, x1, w1
+	}
+	x := (x1*w1 + x2*w2) / (w1 + w2)
+	return math.Max(x1, math.Min(x, x2))
+}
+
+// Quantile estimates the value below which a fraction q of the values
+// fall, interpolating between centroid centres. It is NaN when empty.
+func (t *TDigest) Quantile(q float64) float64 {
+	t.compress()
+	cs := t.merged
+	total := t.mergedW
+	switch {
+	case len(cs) == 0:
+		return math.NaN()
+	case q <= 0:
+		return t.min
+	case q >= 1:
+		return t.max
+	case len(cs) == 1:
+		return cs[0].mean
+	}
+
+	index := q * total
+	if index < 1 {
+		return t.min
+	}
+	// between the minimum and the centre of the first centroid
+	first := cs[0]
+	if first.weight > 1 && index < first.weight/2 {
+		return t.min + (index-1)/(first.weight/2-1)*(first.mean-t.min)
+	}
+	if index > total-1 {
+		return t.max
+	}
+	last := cs[len(cs)-1]
+	if last.weight > 1 && total-index <= last.weight/2 {
+		return t.max - (total-index-1)/(last.weight/2-1)*(t.max-last.mean)
+	}
+
+	soFar := first.weight / 2
+	for i := 0; i < len(cs)-1; i++ {
+		dw := (cs[i].weight + cs[i+1].weight) / 2
+		if soFar+dw > index {
+			// a centroid of weight one is an exact value, not a spread
+			var leftUnit, rightUnit float64
+			if cs[i].weight == 1 {
+				if index-soFar < 0.5 {
+					return cs[i].mean
+				}
+				leftUnit = 0.5
+			}
+			if cs[i+1].weight == 1 {
+				if soFar+dw-index <= 0.5 {
+					return cs[i+1].mean
+				}
+				rightUnit = 0.5
+			}
+			z1 := index - soFar - leftUnit
+			z2 := soFar + dw - index - rightUnit
+			return weightedAverage(cs[i].mean, z2, cs[i+1].mean, z1)
+		}
+		soFar += dw
+	}
+
+	// between the centre of the last centroid and the maximum
+	frac := (index - soFar) / (total - soFar)
+	return last.mean + frac*(t.max-last.mean)
+}
+
+// CDF estimates the fraction of values below x, counting values equal to
+// x as half below. It is NaN when empty.
+func (t *TDigest) CDF(x float64) float64 {
+	t.compress()
+	cs := t.merged
+	total := t.mergedW
+	switch {
+	case len(cs) == 0:
+		return math.NaN()
+	case x < t.min:
+		return 0
+	case x > t.max:
+		return 1
+	case len(cs) == 1:
+		if t.max-t.min == 0 {
+			return 0.5
+		}
+		return (x - t.min) / (t.max - t.min)
+	}
+
+	first := cs[0]
+	if x < first.mean {
+		if first.mean-t.min <= 0 {
+			return 0
+		}
+		if x == t.min {
+			return 0.5 / total
+		}
+		return (1 + (x-t.min)/(first.mean-t.min)*(first.weight/2-1)) / total
+	}
+	last := cs[len(cs)-1]
+	if x > last.mean {
+		if t.max-last.mean <= 0 {
+			return 1
+		}
+		if x == t.max {
+			return 1 - 0.5/total
+		}
+		return 1 - (1+(t.max-x)/(t.max-last.mean)*(last.weight/2-1))/total
+	}
+
+	soFar := 0.0
+	for i := 0; i < len(cs); i++ {
+		if cs[i].mean == x {
+			dw := 0.0
+			for ; i < len(cs) && cs[i].mean == x; i++ {
+				dw += cs[i].weight
+			}
+			return (soFar + dw/2) / total
+		}
+		if i+1 < len(cs) && cs[i].mean < x && x < cs[i+1].mean {
+			var leftExcluded, rightExcluded float64
+			if cs[i].weight == 1 {
+				if cs[i+1].weight == 1 {
+					return (soFar + 1) / total
+				}
+				leftExcluded = 0.5
+			} else if cs[i+1].weight == 1 {
+				rightExcluded = 0.5
+			}
+			dw := (cs[i].weight + cs[i+1].weight) / 2
+			base := soFar + cs[i].weight/2 + leftExcluded
+			frac := (x - cs[i].mean) / (cs[i+1].mean - cs[i].mean)
+			return (base + (dw-leftExcluded-rightExcluded)*frac) / total
+		}
+		soFar += cs[i].weight
+	}
+	return 1 - 0.5/total
+}
+
+// TrimmedMean estimates the mean of the values between the lo and hi
+// quantiles. It is NaN when empty.
+func (t *TDigest) TrimmedMean(lo, hi float64) float64 {
+	t.compress()
+	total := t.mergedW
+	from, to := lo*total, hi*total
+
+	var sum, weight, soFar float64
+	for _, c := range t.merged {
+		// the part of this centroid's weight that falls inside [from, to]
+		w := math.Min(soFar+c.weight, to) - math.Max(soFar, from)
+		if w > 0 {
+			sum += c.mean * w
+			weight += w
+		}
+		soFar += c.weight
+		if soFar >= to {
+			break
+		}
+	}
+	if weight == 0 {
+		return math.NaN()
+	}
+	return sum / weight
+}
+
+// centroids returns every centroid, buffered values included, for
+// persisting the digest.
+func (t *TDigest) centroids() []centroid {
+	return append(append([]centroid{}, t.merged...), t.unmerged...)
+}
+
+func (t *TDigest) clone() *TDigest {
+	cp := *t
+	cp.merged = append([]centroid(nil), t.merged...)
+	cp.unmerged = append([]centroid(nil), t.unmerged...)
+	return &cp
+}
+
+func (t *TDigest) memUsage() int64 {
+	return int64(96 + 16*(cap(t.merged)+cap(t.unmerged)))
+}
+
+// maxMemUsage bounds memUsage after a compress, which leaves at most
+// capacity() centroids.
+func (t *TDigest) maxMemUsage() int64 {
+	return int64(96 + 16*t.capacity())
+}
+
+type tdigestGob struct {
+	Compression float64
+	Min, Max    float64
+	Means       []float64
+	Weights     []float64
+}
+
+func (t *TDigest) GobEncode() ([]byte, error) {
+	g := tdigestGob{Compression: t.compression, Min: t.min, Max: t.max}
+	for _, c := range t.centroids() {
+		g.Means = append(g.Means, c.mean)
+		g.Weights = append(g.Weights, c.weight)
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(g)
+	return buf.Bytes(), err
+}
+
+func (t *TDigest) GobDecode(data []byte) error {
+	var g tdigestGob
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	*t = *NewTDigest(g.Compression)
+	for i, mean := range g.Means {
+		t.addWeighted(mean, g.Weights[i])
+	}
+	if len(g.Means) > 0 {
+		t.min, t.max = g.Min, g.Max
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// rankError is how far, as a fraction of len(sorted), the rank of x lies
+// from q.
+func rankError(sorted []float64, q, x float64) float64 {
+	rank := float64(sort.SearchFloat64s(sorted, x)) / float64(len(sorted))
+	return math.Abs(rank - q)
+}
+
+// checkQuantiles compares the digest of values with the sorted reference.
+// The tails are held to a tighter bound than the middle: that is the point
+// of the k1 scale function.
+func checkQuantiles(t *testing.T, values []float64) {
+	t.Helper()
+	td := NewTDigest(defaultTDigestCompression)
+	for _, v := range values {
+		td.Add(v)
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	if td.Count() != float64(len(values)) {
+		t.Fatalf("Count() = %v, want %d", td.Count(), len(values))
+	}
+	if got := td.Quantile(0); got != sorted[0] {
+		t.Errorf("Quantile(0) = %v, want min %v", got, sorted[0])
+	}
+	if got := td.Quantile(1); got != sorted[len(sorted)-1] {
+		t.Errorf("Quantile(1) = %v, want max %v", got, sorted[len(sorted)-1])
+	}
+
+	for _, tc := range []struct {
+		q, maxErr float64
+	}{
+		{0.001, 0.0005},
+		{0.01, 0.002},
+		{0.1, 0.005},
+		{0.25, 0.01},
+		{0.5, 0.01},
+		{0.75, 0.01},
+		{0.9, 0.005},
+		{0.99, 0.002},
+		{0.999, 0.0005},
+	} {
+		x := td.Quantile(tc.q)
+		if e := rankError(sorted, tc.q, x); e > tc.maxErr {
+			t.Errorf("Quantile(%v) = %v, rank error %.5f > %v", tc.q, x, e, tc.maxErr)
+		}
+	}
+}
+
+func TestTDigestUniform(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	values := make([]float64, 100_000)
+	for i := range values {
+		values[i] = rng.Float64() * 1000
+	}
+	checkQuantiles(t, values)
+}
+
+// TestTDigestSkewed uses a lognormal, which has a long right tail like
+// request latencies, and an exponential, which piles up near zero.
+func TestTDigestSkewed(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	t.Run("lognormal", func(t *testing.T) {
+		values := make([]float64, 100_000)
+		for i := range values {
+			values[i] = math.Exp(rng.NormFloat64() * 2)
+		}
+		checkQuantiles(t, values)
+	})
+	t.Run("exponential", func(t *testing.T) {
+		values := make([]float64, 100_000)
+		for i := range values {
+			values[i] = rng.ExpFloat64() * 5
+		}
+		checkQuantiles(t, values)
+	})
+}
+
+// TestTDigestMerge checks that merging digests of two halves is about as
+// accurate as one digest of the whole.
+func TestTDigestMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	a, b := NewTDigest(defaultTDigestCompression), NewTDigest(defaultTDigestCompression)
+	values := make([]float64, 100_000)
+	for i := range values {
+		values[i] = math.Exp(rng.NormFloat64())
+		if i%2 == 0 {
+			a.Add(values[i])
+		} else {
+			b.Add(values[i])
+		}
+	}
+	a.Merge(b)
+	sort.Float64s(values)
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		x := a.Quantile(q)
+		if e := rankError(values, q, x); e > 0.01 {
+			t.Errorf("merged Quantile(%v) = %v, rank error %.5f", q, x, e)
+		}
+	}
+}
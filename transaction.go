@@ -1,14 +1,113 @@
 package main
 
+import "sync"
+
 type Transaction struct {
 	cmds []*TxCommand
+	// aborted is set when a command failed to queue, e.g. an unknown
+	// command or one with the wrong number of arguments. EXEC then
+	// discards the whole transaction.
+	aborted bool
 }
 
+// execMu isolates transactions. Every command runs holding it for reading,
+// while EXEC holds it for writing, so no other client's command can run in
+// the middle of a transaction. Write commands hold it for writing too, see
+// runIsolated.
+var execMu sync.RWMutex
+
 func NewTransaction() *Transaction {
 	return &Transaction{}
 }
 
 type TxCommand struct {
+	cmd     string
 	r       *Resp
 	handler Handler
 }
+
+// Optimistic locking. While any client WATCHes a key, the key's database
+// keeps a version for it that every modification bumps, be it a write,
+// expiry or eviction. WATCH remembers the version it saw and EXEC aborts
+// when a watched version has moved on.
+
+// watchedKey counts the clients watching a key and versions its changes.
+type watchedKey struct {
+	refs    int
+	version uint64
+}
+
+// watch is a key a client WATCHes, as it was when WATCH ran.
+type watch struct {
+	db      *Database
+	key     string
+	version uint64
+	live    bool // the key existed and had not expired
+}
+
+// touch bumps the version of k if somebody watches it. The caller must
+// hold db.mu.
+func (db *Database) touch(k string) {
+	if wk, ok := db.watched[k]; ok {
+		wk.version++
+	}
+}
+
+// touchAll bumps every watched key in db, after the whole keyspace was
+// replaced by FLUSHDB, FLUSHALL or SWAPDB. The caller must hold db.mu.
+func (db *Database) touchAll() {
+	for _, wk := range db.watched {
+		wk.version++
+	}
+}
+
+// watch starts watching k on behalf of c. The caller must hold db.mu.
+func (db *Database) watch(c *Client, k string) {
+	for _, w := range c.watches {
+		if w.db == db && w.key == k {
+			return
+		}
+	}
+
+	wk, ok := db.watched[k]
+	if !ok {
+		wk = &watchedKey{}
+		db.watched[k] = wk
+	}
+	wk.refs++
+	_, live := db.peek(k)
+	c.watches = append(c.watches, watch{db: db, key: k, version: wk.version, live: live})
+}
+
+// unwatchAll drops every key c watches, as EXEC, DISCARD and UNWATCH do.
+func (c *Client) unwatchAll() {
+	for _, w := range c.watches {
+		w.db.mu.Lock()
+		if wk := w.db.watched[w.key]; wk != nil {
+			wk.refs--
+			if wk.refs == 0 {
+				delete(w.db.watched, w.key)
+			}
+		}
+		w.db.mu.Unlock()
+	}
+	c.watches = nil
+}
+
+// watchesChanged reports whether any key c watches has been modified since
+// it was watched. A key that was live then but has expired since counts as
+// modified even if nobody has reclaimed it yet.
+func (c *Client) watchesChanged() bool {
+	for _, w := range c.watches {
+		w.db.mu.RLock()
+		changed := w.db.watched[w.key].version != w.version
+		if item, ok := w.db.store[w.key]; ok && w.live && item.shouldExpire() {
+			changed = true
+		}
+		w.db.mu.RUnlock()
+		if changed {
+			return true
+		}
+	}
+	return false
+}
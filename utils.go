@@ -1,5 +1,10 @@
 package main
 
+import (
+	"math"
+	"strconv"
+)
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -9,3 +14,15 @@ func contains(s []string, e string) bool {
 
 	return false
 }
+
+// formatFloat renders f the way Redis replies with floating point values:
+// the shortest representation that round-trips, without an exponent.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "inf"
+	}
+	if math.IsInf(f, -1) {
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
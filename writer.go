@@ -46,6 +46,8 @@ func (w *Writer) Write(r *Resp) {
 	w.writer.Write([]byte(reply))
 }
 
-func (w *Writer) Flush() {
-	w.writer.(*bufio.Writer).Flush()
+// Flush writes out buffered replies. Its error is the first one any write
+// through w ran into.
+func (w *Writer) Flush() error {
+	return w.writer.(*bufio.Writer).Flush()
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+)
+
+// Sorted sets pair a member -> score map with a skiplist ordered by
+// (score, member), the same layout Redis uses. The skiplist keeps span
+// counts on every link so rank lookups and range queries are O(log n).
+
+const (
+	zslMaxLevel = 32
+	zslP        = 0.25
+)
+
+type zslLevel struct {
+	forward *zslNode
+	span    int
+}
+
+type zslNode struct {
+	member string
+	score  float64
+	back   *zslNode
+	level  []zslLevel
+}
+
+type skiplist struct {
+	header *zslNode
+	tail   *zslNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &zslNode{level: make([]zslLevel, zslMaxLevel)},
+		level:  1,
+	}
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for level < zslMaxLevel && rand.Float64() < zslP {
+		level++
+	}
+	return level
+}
+
+// zslLess orders nodes by score, breaking ties on the member name.
+func zslLess(score float64, member string, n *zslNode) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+func (zsl *skiplist) insert(score float64, member string) *zslNode {
+	var update [zslMaxLevel]*zslNode
+	var rank [zslMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslLess(score, member, x.level[i].forward) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &zslNode{member: member, score: score, level: make([]zslLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.back = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.back = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+func (zsl *skiplist) deleteNode(x *zslNode, update []*zslNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.back = x.back
+	} else {
+		zsl.tail = x.back
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+func (zsl *skiplist) delete(score float64, member string) bool {
+	update := make([]*zslNode, zslMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLess(score, member, x.level[i].forward) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	zsl.deleteNode(x, update)
+	return true
+}
+
+// rank returns the 1-based rank of the element, or 0 when it is missing.
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(zslLess(score, member, x.level[i].forward) ||
+				(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the given 1-based rank.
+func (zsl *skiplist) byRank(rank int) *zslNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstMatch returns the first node for which above holds, where above
+// must be monotonic along the list (false ... false, true ... true).
+func (zsl *skiplist) firstMatch(above func(*zslNode) bool) *zslNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !above(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	return x.level[0].forward
+}
+
+// lastMatch returns the last node for which within holds, where within
+// must be monotonic along the list (true ... true, false ... false).
+func (zsl *skiplist) lastMatch(within func(*zslNode) bool) *zslNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && within(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header {
+		return nil
+	}
+	return x
+}
+
+// scoreRange is a score interval as given to ZCOUNT or ZRANGE BYSCORE.
+type scoreRange struct {
+	min, max     float64
+	minEx, maxEx bool
+}
+
+func (r scoreRange) aboveMin(score float64) bool {
+	if r.minEx {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r scoreRange) belowMax(score float64) bool {
+	if r.maxEx {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+// lexRange is a member interval as given to ZRANGE BYLEX. The unbounded
+// ends "-" and "+" are flagged by minInf and maxInf.
+type lexRange struct {
+	min, max       string
+	minEx, maxEx   bool
+	minInf, maxInf bool
+}
+
+func (r lexRange) aboveMin(member string) bool {
+	switch {
+	case r.minInf:
+		return true
+	case r.minEx:
+		return member > r.min
+	default:
+		return member >= r.min
+	}
+}
+
+func (r lexRange) belowMax(member string) bool {
+	switch {
+	case r.maxInf:
+		return true
+	case r.maxEx:
+		return member < r.max
+	default:
+		return member <= r.max
+	}
+}
+
+type zEntry struct {
+	member string
+	score  float64
+}
+
+type ZSet struct {
+	dict map[string]float64
+	zsl  *skiplist
+	size int64 // total bytes held by the members
+}
+
+func NewZSet() *ZSet {
+	return &ZSet{
+		dict: map[string]float64{},
+		zsl:  newSkiplist(),
+	}
+}
+
+func (z *ZSet) Len() int {
+	return len(z.dict)
+}
+
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// Add sets the score of member and reports whether it is a new member.
+func (z *ZSet) Add(member string, score float64) bool {
+	old, ok := z.dict[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	} else {
+		z.size += int64(len(member))
+	}
+	z.dict[member] = score
+	z.zsl.insert(score, member)
+	return !ok
+}
+
+func (z *ZSet) Remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	delete(z.dict, member)
+	z.zsl.delete(score, member)
+	z.size -= int64(len(member))
+	return true
+}
+
+// Rank returns the 0-based position of member, counted from the highest
+// score when rev is set.
+func (z *ZSet) Rank(member string, rev bool) (int, bool) {
+	score, ok := z.dict[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.zsl.rank(score, member)
+	if rev {
+		return z.zsl.length - rank, true
+	}
+	return rank - 1, true
+}
+
+// walk collects up to limit entries starting at x, moving backwards when
+// rev is set, while keep holds. A negative limit means no limit.
+func walk(x *zslNode, rev bool, limit int, keep func(*zslNode) bool) []zEntry {
+	var entries []zEntry
+	for x != nil && limit != 0 && keep(x) {
+		entries = append(entries, zEntry{member: x.member, score: x.score})
+		limit--
+		if rev {
+			x = x.back
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return entries
+}
+
+func skip(x *zslNode, rev bool, offset int) *zslNode {
+	for ; x != nil && offset > 0; offset-- {
+		if rev {
+			x = x.back
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return x
+}
+
+// RangeByRank returns the entries between the inclusive ranks start and
+// stop, where negative ranks count from the end.
+func (z *ZSet) RangeByRank(start, stop int, rev bool) []zEntry {
+	start, stop, ok := clampRange(start, stop, z.Len())
+	if !ok {
+		return nil
+	}
+
+	var x *zslNode
+	if rev {
+		x = z.zsl.byRank(z.zsl.length - start)
+	} else {
+		x = z.zsl.byRank(start + 1)
+	}
+	return walk(x, rev, stop-start+1, func(*zslNode) bool { return true })
+}
+
+func (z *ZSet) RangeByScore(r scoreRange, rev bool, offset, limit int) []zEntry {
+	var x *zslNode
+	var keep func(*zslNode) bool
+	if rev {
+		x = z.zsl.lastMatch(func(n *zslNode) bool { return r.belowMax(n.score) })
+		keep = func(n *zslNode) bool { return r.aboveMin(n.score) }
+	} else {
+		x = z.zsl.firstMatch(func(n *zslNode) bool { return r.aboveMin(n.score) })
+		keep = func(n *zslNode) bool { return r.belowMax(n.score) }
+	}
+	return walk(skip(x, rev, offset), rev, limit, keep)
+}
+
+func (z *ZSet) RangeByLex(r lexRange, rev bool, offset, limit int) []zEntry {
+	var x *zslNode
+	var keep func(*zslNode) bool
+	if rev {
+		x = z.zsl.lastMatch(func(n *zslNode) bool { return r.belowMax(n.member) })
+		keep = func(n *zslNode) bool { return r.aboveMin(n.member) }
+	} else {
+		x = z.zsl.firstMatch(func(n *zslNode) bool { return r.aboveMin(n.member) })
+		keep = func(n *zslNode) bool { return r.belowMax(n.member) }
+	}
+	return walk(skip(x, rev, offset), rev, limit, keep)
+}
+
+// Count returns the number of members with a score inside r, using ranks
+// so no members are visited.
+func (z *ZSet) Count(r scoreRange) int {
+	first := z.zsl.firstMatch(func(n *zslNode) bool { return r.aboveMin(n.score) })
+	if first == nil || !r.belowMax(first.score) {
+		return 0
+	}
+	last := z.zsl.lastMatch(func(n *zslNode) bool { return r.belowMax(n.score) })
+	return z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+}
+
+// Pop removes up to count members with the lowest scores, or the highest
+// when max is set.
+func (z *ZSet) Pop(count int, max bool) []zEntry {
+	var popped []zEntry
+	for len(popped) < count && z.Len() > 0 {
+		x := z.zsl.header.level[0].forward
+		if max {
+			x = z.zsl.tail
+		}
+		popped = append(popped, zEntry{member: x.member, score: x.score})
+		z.Remove(x.member)
+	}
+	return popped
+}
+
+func (z *ZSet) Entries() []zEntry {
+	return z.RangeByRank(0, -1, false)
+}
+
+func (z *ZSet) memUsage() int64 {
+	stringHeader := 16
+	mapEntrySize := 32
+	// dict entry plus a skiplist node of average height 1/(1-p)
+	nodeSize := 48 + 16*4/3
+	return int64(len(z.dict)*(stringHeader+mapEntrySize+8+nodeSize)) + z.size
+}
+
+func (z *ZSet) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(z.dict)
+	return buf.Bytes(), err
+}
+
+func (z *ZSet) GobDecode(data []byte) error {
+	dict := map[string]float64{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&dict); err != nil {
+		return err
+	}
+	*z = *NewZSet()
+	for m, score := range dict {
+		z.Add(m, score)
+	}
+	return nil
+}